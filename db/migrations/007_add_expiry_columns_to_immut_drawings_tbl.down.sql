@@ -0,0 +1,4 @@
+DROP INDEX idx_immut_drawings_expires_at ON immutable_drawings;
+
+ALTER TABLE immutable_drawings DROP COLUMN max_views;
+ALTER TABLE immutable_drawings DROP COLUMN expires_at;
@@ -0,0 +1,4 @@
+ALTER TABLE immutable_drawings ADD COLUMN expires_at DATETIME NULL;
+ALTER TABLE immutable_drawings ADD COLUMN max_views INT NULL;
+
+CREATE INDEX idx_immut_drawings_expires_at ON immutable_drawings(expires_at);
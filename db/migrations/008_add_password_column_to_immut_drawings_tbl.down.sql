@@ -0,0 +1 @@
+ALTER TABLE immutable_drawings DROP COLUMN password;
@@ -0,0 +1 @@
+ALTER TABLE immutable_drawings ADD COLUMN password VARCHAR(80) NULL;
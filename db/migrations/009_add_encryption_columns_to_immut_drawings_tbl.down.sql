@@ -0,0 +1,2 @@
+ALTER TABLE immutable_drawings DROP COLUMN algorithm;
+ALTER TABLE immutable_drawings DROP COLUMN ciphertext;
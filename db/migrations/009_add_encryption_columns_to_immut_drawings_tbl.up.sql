@@ -0,0 +1,2 @@
+ALTER TABLE immutable_drawings ADD COLUMN ciphertext MEDIUMTEXT NULL;
+ALTER TABLE immutable_drawings ADD COLUMN algorithm VARCHAR(50) NULL;
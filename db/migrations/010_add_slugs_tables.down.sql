@@ -0,0 +1,2 @@
+DROP TABLE slug_history;
+DROP TABLE slugs;
@@ -0,0 +1,18 @@
+CREATE TABLE slugs (
+    slug VARCHAR(64) NOT NULL,
+    user_id MEDIUMINT NOT NULL,
+    short_key VARCHAR(10) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (slug),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE slug_history (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    slug VARCHAR(64) NOT NULL,
+    short_key VARCHAR(10) NOT NULL,
+    replaced_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (slug) REFERENCES slugs(slug)
+);
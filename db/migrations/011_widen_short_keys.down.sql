@@ -0,0 +1,5 @@
+DROP INDEX idx_immut_drawings_hash ON immutable_drawings;
+
+ALTER TABLE slug_history MODIFY short_key VARCHAR(10) NOT NULL;
+ALTER TABLE slugs MODIFY short_key VARCHAR(10) NOT NULL;
+ALTER TABLE immutable_drawings MODIFY short_key VARCHAR(10);
@@ -0,0 +1,5 @@
+ALTER TABLE immutable_drawings MODIFY short_key VARCHAR(32);
+ALTER TABLE slugs MODIFY short_key VARCHAR(32) NOT NULL;
+ALTER TABLE slug_history MODIFY short_key VARCHAR(32) NOT NULL;
+
+CREATE INDEX idx_immut_drawings_hash ON immutable_drawings(hash);
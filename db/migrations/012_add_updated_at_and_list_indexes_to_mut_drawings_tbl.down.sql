@@ -0,0 +1,5 @@
+DROP INDEX idx_mut_drawings_user_name ON mutable_drawings;
+DROP INDEX idx_mut_drawings_user_updated ON mutable_drawings;
+DROP INDEX idx_mut_drawings_user_created ON mutable_drawings;
+
+ALTER TABLE mutable_drawings DROP COLUMN updated_at;
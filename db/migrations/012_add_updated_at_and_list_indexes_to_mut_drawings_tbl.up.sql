@@ -0,0 +1,7 @@
+ALTER TABLE mutable_drawings ADD COLUMN updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP;
+
+UPDATE mutable_drawings SET updated_at = created_at;
+
+CREATE INDEX idx_mut_drawings_user_created ON mutable_drawings(user_id, created_at, id);
+CREATE INDEX idx_mut_drawings_user_updated ON mutable_drawings(user_id, updated_at, id);
+CREATE INDEX idx_mut_drawings_user_name ON mutable_drawings(user_id, name, id);
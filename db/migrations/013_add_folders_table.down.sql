@@ -0,0 +1,4 @@
+ALTER TABLE mutable_drawings DROP FOREIGN KEY fk_mut_drawings_folder;
+ALTER TABLE mutable_drawings DROP COLUMN folder_id;
+
+DROP TABLE folders;
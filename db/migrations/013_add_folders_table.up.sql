@@ -0,0 +1,13 @@
+CREATE TABLE folders (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    user_id MEDIUMINT NOT NULL,
+    parent_id MEDIUMINT NULL,
+    name VARCHAR(100) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (parent_id) REFERENCES folders(id)
+);
+
+ALTER TABLE mutable_drawings ADD COLUMN folder_id MEDIUMINT NULL;
+ALTER TABLE mutable_drawings ADD CONSTRAINT fk_mut_drawings_folder FOREIGN KEY (folder_id) REFERENCES folders(id);
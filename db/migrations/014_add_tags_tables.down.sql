@@ -0,0 +1,2 @@
+DROP TABLE mutable_drawing_tags;
+DROP TABLE tags;
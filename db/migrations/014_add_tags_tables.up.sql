@@ -0,0 +1,18 @@
+CREATE TABLE tags (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    user_id MEDIUMINT NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE mutable_drawing_tags (
+    drawing_id MEDIUMINT NOT NULL,
+    tag_id MEDIUMINT NOT NULL,
+    PRIMARY KEY (drawing_id, tag_id),
+    FOREIGN KEY (drawing_id) REFERENCES mutable_drawings(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_mut_drawing_tags_tag_id ON mutable_drawing_tags(tag_id);
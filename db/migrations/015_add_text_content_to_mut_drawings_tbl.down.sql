@@ -0,0 +1,3 @@
+DROP INDEX idx_mut_drawings_fulltext ON mutable_drawings;
+
+ALTER TABLE mutable_drawings DROP COLUMN text_content;
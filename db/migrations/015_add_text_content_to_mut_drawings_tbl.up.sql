@@ -0,0 +1,3 @@
+ALTER TABLE mutable_drawings ADD COLUMN text_content MEDIUMTEXT NULL;
+
+CREATE FULLTEXT INDEX idx_mut_drawings_fulltext ON mutable_drawings(name, text_content);
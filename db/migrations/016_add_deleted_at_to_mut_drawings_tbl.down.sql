@@ -0,0 +1,4 @@
+DROP INDEX idx_mut_drawings_deleted ON mutable_drawings;
+DROP INDEX idx_mut_drawings_user_deleted ON mutable_drawings;
+
+ALTER TABLE mutable_drawings DROP COLUMN deleted_at;
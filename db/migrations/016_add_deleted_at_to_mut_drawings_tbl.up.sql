@@ -0,0 +1,4 @@
+ALTER TABLE mutable_drawings ADD COLUMN deleted_at DATETIME NULL;
+
+CREATE INDEX idx_mut_drawings_user_deleted ON mutable_drawings(user_id, deleted_at);
+CREATE INDEX idx_mut_drawings_deleted ON mutable_drawings(deleted_at);
@@ -0,0 +1,2 @@
+ALTER TABLE mutable_drawings DROP COLUMN forked_from_short_key;
+ALTER TABLE mutable_drawings DROP COLUMN forked_from_id;
@@ -0,0 +1,2 @@
+ALTER TABLE mutable_drawings ADD COLUMN forked_from_id MEDIUMINT NULL;
+ALTER TABLE mutable_drawings ADD COLUMN forked_from_short_key VARCHAR(32) NULL;
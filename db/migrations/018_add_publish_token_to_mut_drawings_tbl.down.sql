@@ -0,0 +1,2 @@
+DROP INDEX idx_mut_drawings_publish_token ON mutable_drawings;
+ALTER TABLE mutable_drawings DROP COLUMN publish_token;
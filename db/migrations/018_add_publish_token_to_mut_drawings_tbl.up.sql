@@ -0,0 +1,3 @@
+ALTER TABLE mutable_drawings ADD COLUMN publish_token VARCHAR(32) NULL;
+
+CREATE UNIQUE INDEX idx_mut_drawings_publish_token ON mutable_drawings(publish_token);
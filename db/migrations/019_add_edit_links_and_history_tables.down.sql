@@ -0,0 +1,2 @@
+DROP TABLE mutable_drawing_history;
+DROP TABLE edit_links;
@@ -0,0 +1,23 @@
+CREATE TABLE edit_links (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    drawing_id MEDIUMINT NOT NULL,
+    token_hash CHAR(128) NOT NULL,
+    expires_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE (token_hash),
+    FOREIGN KEY (drawing_id) REFERENCES mutable_drawings(id) ON DELETE CASCADE
+);
+
+CREATE TABLE mutable_drawing_history (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    drawing_id MEDIUMINT NOT NULL,
+    edit_link_id MEDIUMINT NULL,
+    edited_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (drawing_id) REFERENCES mutable_drawings(id) ON DELETE CASCADE,
+    FOREIGN KEY (edit_link_id) REFERENCES edit_links(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_mut_drawing_history_drawing_id ON mutable_drawing_history(drawing_id, edited_at);
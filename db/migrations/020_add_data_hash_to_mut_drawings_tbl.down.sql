@@ -0,0 +1,2 @@
+DROP INDEX idx_mut_drawings_user_data_hash ON mutable_drawings;
+ALTER TABLE mutable_drawings DROP COLUMN data_hash;
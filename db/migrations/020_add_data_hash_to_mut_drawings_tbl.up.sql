@@ -0,0 +1,3 @@
+ALTER TABLE mutable_drawings ADD COLUMN data_hash CHAR(128) NULL;
+
+CREATE INDEX idx_mut_drawings_user_data_hash ON mutable_drawings(user_id, data_hash);
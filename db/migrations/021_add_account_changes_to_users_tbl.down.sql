@@ -0,0 +1,4 @@
+DROP INDEX idx_users_delete_at ON users;
+
+ALTER TABLE users DROP COLUMN delete_at;
+ALTER TABLE users DROP COLUMN pending_email;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN pending_email VARCHAR(255) NULL;
+ALTER TABLE users ADD COLUMN delete_at DATETIME NULL;
+
+CREATE INDEX idx_users_delete_at ON users(delete_at);
@@ -0,0 +1,14 @@
+CREATE TABLE data_exports (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    user_id MEDIUMINT NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending',
+    file_name VARCHAR(255) NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME NULL,
+    expires_at DATETIME NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX idx_data_exports_status ON data_exports(status);
+CREATE INDEX idx_data_exports_expires_at ON data_exports(expires_at);
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NULL;
+ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME NULL;
+-- The last time step a code was accepted for, so codes can't be replayed.
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NULL;
+ALTER TABLE users ADD COLUMN totp_failures SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_failed_at DATETIME NULL;
+
+CREATE TABLE recovery_codes (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    user_id MEDIUMINT NOT NULL,
+    code_hash CHAR(128) NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes(user_id, code_hash);
@@ -0,0 +1,4 @@
+ALTER TABLE users DROP FOREIGN KEY fk_users_invite;
+ALTER TABLE users DROP COLUMN invite_id;
+
+DROP TABLE invites;
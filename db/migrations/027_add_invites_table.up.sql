@@ -0,0 +1,17 @@
+CREATE TABLE invites (
+    id MEDIUMINT NOT NULL AUTO_INCREMENT,
+    user_id MEDIUMINT NOT NULL,
+    code_hash CHAR(128) NOT NULL,
+    -- NULL for no limit.
+    max_uses MEDIUMINT NULL,
+    uses MEDIUMINT NOT NULL DEFAULT 0,
+    expires_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE (code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE users ADD COLUMN invite_id MEDIUMINT NULL;
+ALTER TABLE users ADD CONSTRAINT fk_users_invite FOREIGN KEY (invite_id) REFERENCES invites(id) ON DELETE SET NULL;
@@ -0,0 +1,8 @@
+-- The keys can't be recovered from their hashes, so everyone is logged out.
+DELETE FROM sessions;
+
+DROP INDEX idx_sessions_previous_key_hash ON sessions;
+ALTER TABLE sessions DROP COLUMN rotated_at;
+ALTER TABLE sessions DROP COLUMN previous_key_hash;
+ALTER TABLE sessions DROP PRIMARY KEY, DROP COLUMN key_hash;
+ALTER TABLE sessions ADD COLUMN session_key VARCHAR(255) NOT NULL, ADD PRIMARY KEY (session_key);
@@ -0,0 +1,14 @@
+-- Only the SHA-256 of each key is kept from now on. Existing sessions are
+-- converted in place, so no one is logged out.
+ALTER TABLE sessions ADD COLUMN key_hash CHAR(64) NULL;
+UPDATE sessions SET key_hash = SHA2(session_key, 256);
+ALTER TABLE sessions DROP PRIMARY KEY, DROP COLUMN session_key;
+ALTER TABLE sessions MODIFY key_hash CHAR(64) NOT NULL, ADD PRIMARY KEY (key_hash);
+
+-- The key a session was rotated from, still accepted for a little while.
+ALTER TABLE sessions ADD COLUMN previous_key_hash CHAR(64) NULL;
+ALTER TABLE sessions ADD COLUMN rotated_at DATETIME NULL;
+UPDATE sessions SET rotated_at = UTC_TIMESTAMP();
+ALTER TABLE sessions MODIFY rotated_at DATETIME NOT NULL;
+
+CREATE INDEX idx_sessions_previous_key_hash ON sessions(previous_key_hash);
@@ -0,0 +1,2 @@
+ALTER TABLE immutable_drawings MODIFY password VARCHAR(80) NULL;
+ALTER TABLE users MODIFY password VARCHAR(80);
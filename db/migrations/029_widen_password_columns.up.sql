@@ -0,0 +1,3 @@
+-- Argon2id hashes are longer than bcrypt ones.
+ALTER TABLE users MODIFY password VARCHAR(255);
+ALTER TABLE immutable_drawings MODIFY password VARCHAR(255) NULL;
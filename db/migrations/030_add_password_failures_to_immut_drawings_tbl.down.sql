@@ -0,0 +1,2 @@
+ALTER TABLE immutable_drawings DROP COLUMN password_failed_at;
+ALTER TABLE immutable_drawings DROP COLUMN password_failures;
@@ -0,0 +1,2 @@
+ALTER TABLE immutable_drawings ADD COLUMN password_failures SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE immutable_drawings ADD COLUMN password_failed_at DATETIME NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE data_exports ADD COLUMN started_at DATETIME NULL;
+
+-- Exports already running are taken to have started when they were queued.
+UPDATE data_exports SET started_at = created_at WHERE status = 'running';
@@ -0,0 +1,3 @@
+ALTER TABLE sessions ADD COLUMN authenticated_at DATETIME NULL;
+UPDATE sessions SET authenticated_at = rotated_at;
+ALTER TABLE sessions MODIFY authenticated_at DATETIME NOT NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE mutable_drawings MODIFY forked_from_short_key VARCHAR(32) NULL;
+ALTER TABLE slug_history MODIFY short_key VARCHAR(32) NOT NULL;
+ALTER TABLE slugs MODIFY short_key VARCHAR(32) NOT NULL;
+ALTER TABLE immutable_drawings MODIFY short_key VARCHAR(32);
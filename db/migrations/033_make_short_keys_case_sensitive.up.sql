@@ -0,0 +1,5 @@
+-- Short keys are base62, so they're case sensitive.
+ALTER TABLE immutable_drawings MODIFY short_key VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin;
+ALTER TABLE slugs MODIFY short_key VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin NOT NULL;
+ALTER TABLE slug_history MODIFY short_key VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin NOT NULL;
+ALTER TABLE mutable_drawings MODIFY forked_from_short_key VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin NULL;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN verification_sent_at DATETIME NULL;
@@ -37,6 +37,30 @@ async function patchRequest(url, data) {
 }
 
 
+function base64ToBytes(value) {
+  // Accepts both standard and URL safe (e.g. from a URL fragment) base64.
+  let normalised = value.replace(/-/g, "+").replace(/_/g, "/");
+  return Uint8Array.from(atob(normalised), c => c.charCodeAt(0));
+}
+
+async function decryptDrawing(response) {
+  // The key only ever lives in the URL fragment, which browsers don't send to
+  // the server. The ciphertext is a 12 byte IV followed by the AES-GCM output.
+  if (response.algorithm != "AES-GCM") return null;
+  try {
+    let key = await crypto.subtle.importKey(
+      "raw", base64ToBytes(window.location.hash.substring(1)), "AES-GCM", false, ["decrypt"],
+    );
+    let bytes = base64ToBytes(response.ciphertext);
+    let data = await crypto.subtle.decrypt(
+      { name: "AES-GCM", iv: bytes.slice(0, 12) }, key, bytes.slice(12),
+    );
+    return new TextDecoder().decode(data);
+  } catch {
+    return null;
+  }
+}
+
 function handleResponse(response, msg = "", silentErr = false) {
   if (response.error && response.error.length > 0) {
     if (!silentErr) bodyComponent.informerComponent.report(response.error, "bad");
@@ -90,6 +114,7 @@ class RouteManager {
 class UserManager {
   constructor() {
     this.user = null;
+    this.inviteCode = null;
   }
 
   isLoggedin() {
@@ -139,7 +164,10 @@ class UserManager {
   }
 
   async signup(data) {
-    if (handleResponse(await this.signupUser(data), "Successfully signed up!")) {
+    let msg = "Successfully signed up! Check your email for a link to verify it.";
+    if (this.inviteCode) data.invite_code = this.inviteCode;
+    if (handleResponse(await this.signupUser(data), msg)) {
+      this.inviteCode = null;
       bodyComponent.signupComponent.hide();
       bodyComponent.loginComponent.formComponent.formFieldEmail.setValue(
         bodyComponent.signupComponent.formComponent.formFieldEmail.getValue()
@@ -160,8 +188,24 @@ class UserManager {
     this.isLoggedin() ? this.renderLogin() : this.renderLogout();
   }
 
+  // Users with 2FA get a token to finish logging in with, given a code.
+  async completeMfa(response) {
+    if (!response.mfa_token) return response;
+    let code = window.prompt("Enter the code from your authenticator app, or a recovery code:");
+    if (!code) return { error: "Login cancelled" };
+    return await this.mfaAuth({ mfa_token: response.mfa_token, code: code });
+  }
+
   async login(data) {
-    if (handleResponse(await this.loginUser(data))) {
+    let response = await this.completeMfa(await this.loginUser(data));
+    if (response.error === "Email not verified") {
+      await this.resendVerification({ email: data.email });
+      bodyComponent.informerComponent.report(
+        "Please verify your email first, we've sent you another link.", "bad"
+      );
+      return;
+    }
+    if (handleResponse(response)) {
       await userManager.update();
       if (!this.isLoggedin()) return;
 
@@ -175,6 +219,45 @@ class UserManager {
     }
   }
 
+  async requestLoginLink() {
+    let email = bodyComponent.loginComponent.formComponent.formFieldEmail.getValue();
+    if (!email.length) {
+      bodyComponent.informerComponent.report("Enter your email first.", "bad");
+      return;
+    }
+    let msg = "If there's an account for that email, a login link is on its way.";
+    handleResponse(await this.loginLink({ email: email }), msg);
+  }
+
+  // Users with 2FA logging in through a provider land on /m/<token>.
+  async openMfaLogin(token) {
+    window.history.replaceState(null, document.title, "/");
+    if (handleResponse(await this.completeMfa({ mfa_token: token }))) {
+      await this.update();
+      if (this.isLoggedin()) bodyComponent.informerComponent.report("Successfully logged in!", "good");
+    }
+  }
+
+  // Invite links land on /i/<code>, which is kept for signing up with.
+  openInvite(code) {
+    window.history.replaceState(null, document.title, "/");
+    if (this.isLoggedin()) return;
+    this.inviteCode = code;
+    bodyComponent.signupComponent.show();
+  }
+
+  async openLoginLink(token) {
+    let response = await this.completeMfa(await this.redeemLoginLink({ token: token }));
+    window.history.replaceState(null, document.title, "/");
+    if (handleResponse(response)) {
+      await this.update();
+      if (!this.isLoggedin()) return;
+      drawingManager.unsetCurrentDrawing();
+      drawingManager.setUnsaved();
+      bodyComponent.informerComponent.report("Successfully logged in!", "good");
+    }
+  }
+
   async logout() {
     if (handleResponse(await this.logoutUser())) {
       await this.update();
@@ -199,6 +282,26 @@ class UserManager {
   async signupUser(data) {
     return await pRequest("/api/user/", data);
   }
+
+  async getOidcProviders() {
+    return await request("/api/user/oidc");
+  }
+
+  async mfaAuth(data) {
+    return await pRequest("/api/user/auth/mfa", data);
+  }
+
+  async loginLink(data) {
+    return await pRequest("/api/user/login-link", data);
+  }
+
+  async redeemLoginLink(data) {
+    return await pRequest("/api/user/login-link/redeem", data);
+  }
+
+  async resendVerification(data) {
+    return await pRequest("/api/user/verify/resend", data);
+  }
 }
 
 class DrawingManager {
@@ -210,8 +313,13 @@ class DrawingManager {
     return Boolean(localStorage.getItem("serverSaved"));
   }
 
+  canSave() {
+    // Edit links allow saving their one drawing without logging in.
+    return userManager.isLoggedin() || Boolean(this.getEditToken());
+  }
+
   setUnsaved() {
-    if (!userManager.isLoggedin()) return;
+    if (!this.canSave()) return;
     // If there is nothing, then don't offer save option.
     if (layerManager.layers.length == 0) {
       drawingManager.setSaved();
@@ -223,7 +331,7 @@ class DrawingManager {
   }
 
   setSaved() {
-    if (!userManager.isLoggedin()) return;
+    if (!this.canSave()) return;
     localStorage.setItem("serverSaved", "true");
     bodyComponent.rightMenuComponent.saveButtonComponent.hide();
   }
@@ -237,7 +345,7 @@ class DrawingManager {
   }
 
   isNewDrawing() {
-    return !this.getCurrentDrawing();
+    return !this.getCurrentDrawing() && !this.getEditToken();
   }
 
   getCurrentDrawing() {
@@ -246,6 +354,15 @@ class DrawingManager {
 
   setCurrentDrawing(id) {
     localStorage.setItem("currentDrawingId", id);
+    this.setEditToken("");
+  }
+
+  getEditToken() {
+    return localStorage.getItem("editToken");
+  }
+
+  setEditToken(token) {
+    localStorage.setItem("editToken", token);
   }
 
   unsetCurrentDrawing() {
@@ -310,21 +427,20 @@ class DrawingManager {
 
   async duplicate(drawingId) {
     if (await this.ensureSave()) return;
-    // Same as this.open except we don't set the drawing as current so it is saved
-    // as a new one.
-    let response = await this.getDrawing(drawingId);
-    if (handleResponse(response, "Successfully made duplicate. Saving this will create a new drawing.")) {
-      layerManager.import(response.data);
-      bodyComponent.hidePopups();
-
-      this.unsetCurrentDrawing();
-      // We setUnsaved because a user should be able to save a copy regardless of change.
-      this.setUnsaved();
+    // The copy (tags included) is made server side, then opened like any other.
+    let response = await this.duplicateDrawing(drawingId);
+    if (handleResponse(response)) {
+      await this.open(response.id);
+      bodyComponent.informerComponent.report("Successfully made duplicate!", "good");
     }
   }
 
   async openFromShortKey(shortKey) {
     let response = await this.getImmutableDrawing(shortKey);
+    if (response.encrypted) {
+      response.data = await decryptDrawing(response);
+      if (response.data == null) response.error = "Unable to decrypt drawing";
+    }
     if (handleResponse(response, "Successfully loaded. This is your own version of the original to edit freely.")) {
       // It's important we load into localStorage too immediately as a side effect.
       // layerManager.import currently does this impliclity with redraw.
@@ -342,6 +458,55 @@ class DrawingManager {
     }
   }
 
+  async openFromEditLink(token) {
+    if (await this.ensureSave()) return;
+    let response = await this.getEditLinkDrawing(token);
+    if (handleResponse(response, "Successfully loaded! Saving updates the shared drawing.")) {
+      layerManager.import(response.data);
+      bodyComponent.hidePopups();
+      this.unsetCurrentDrawing();
+      this.setEditToken(token);
+      this.setSaved();
+    }
+  }
+
+  async createEditLink(drawingId) {
+    let response = await this.createEditLinkRequest(drawingId);
+    if (handleResponse(response)) {
+      let url = `${window.location.protocol}//${window.location.host}/e/${response.token}`;
+      await navigator.clipboard.writeText(url);
+      bodyComponent.informerComponent.report("Edit link copied to clipboard!", "good");
+    }
+  }
+
+  async openPublished(token) {
+    let response = await this.getPublishedDrawing(token);
+    if (handleResponse(response, "Loaded the latest version. Edits are your own copy.")) {
+      layerManager.import(response.data);
+      bodyComponent.hidePopups();
+      this.unsetCurrentDrawing();
+      this.setUnsaved();
+      // Unlike short keys, the URL is kept so a reload shows the latest version.
+    }
+  }
+
+  async publish(drawingId, callback) {
+    let response = await this.publishDrawing(drawingId);
+    if (handleResponse(response)) {
+      let url = `${window.location.protocol}//${window.location.host}/p/${response.publish_token}`;
+      await navigator.clipboard.writeText(url);
+      await callback();
+      bodyComponent.informerComponent.report("Published! Link copied to clipboard.", "good");
+    }
+  }
+
+  async unpublish(drawingId, callback) {
+    if (handleResponse(await this.unpublishDrawing(drawingId))) {
+      await callback();
+      bodyComponent.informerComponent.report("Unpublished!", "good");
+    }
+  }
+
   async delete(drawingId, callback) {
     if (handleResponse(await this.deleteDrawing(drawingId))) {
       // We do this so that saving doesn't attempt to save to a non-existent drawing.
@@ -350,12 +515,20 @@ class DrawingManager {
       if (drawingId == this.getCurrentDrawing()) this.unsetCurrentDrawing();
       await callback();
       // This get's defered so that listing loading doesn't replace it.
-      bodyComponent.informerComponent.report("Successfully deleted!", "good");
+      bodyComponent.informerComponent.report("Moved to trash!", "good");
     }
   }
 
   async getDrawings() {
-    return (await request("/api/drawings/mutables")).results || [];
+    // The list is paginated, so follow the pages to show every drawing.
+    let drawings = [];
+    let cursor = "";
+    do {
+      let response = await request("/api/drawings/mutables?cursor=" + encodeURIComponent(cursor));
+      drawings = drawings.concat(response.results || []);
+      cursor = response.next_cursor || "";
+    } while (cursor.length > 0);
+    return drawings;
   }
 
   async getDrawing(drawingId) {
@@ -366,15 +539,40 @@ class DrawingManager {
     return await request("/api/drawings/immutable/" + shortKey);
   }
 
+  async getPublishedDrawing(token) {
+    return await request("/api/drawings/published/" + token);
+  }
+
+  async publishDrawing(drawingId) {
+    return await pRequest("/api/drawings/mutable/" + drawingId + "/publish", {});
+  }
+
+  async unpublishDrawing(drawingId) {
+    return await deleteRequest("/api/drawings/mutable/" + drawingId + "/publish");
+  }
+
   async deleteDrawing(drawingId) {
     return await deleteRequest("/api/drawings/mutable/" + drawingId);
   }
 
+  async duplicateDrawing(drawingId) {
+    return await pRequest("/api/drawings/mutable/" + drawingId + "/duplicate", {});
+  }
+
   async saveDrawing(id) {
     let data = { data: layerManager.encodeAll() };
+    if (this.getEditToken()) return await patchRequest("/api/drawings/edit/" + this.getEditToken(), data);
     return await patchRequest("/api/drawings/mutable/" + id, data);
   }
 
+  async getEditLinkDrawing(token) {
+    return await request("/api/drawings/edit/" + token);
+  }
+
+  async createEditLinkRequest(drawingId) {
+    return await pRequest("/api/drawings/mutable/" + drawingId + "/edit-links", {});
+  }
+
   async updateMetadataDrawing(id, data) {
     return await patchRequest("/api/drawings/mutable/" + id, data);
   }
@@ -453,6 +651,21 @@ class ListDrawingsComponent extends PopupComponent {
                   css_padding: "2px",
                   on_mousedown: () => drawingManager.duplicate(drawing.id),
                 }),
+                new ButtonComponent({
+                  value: drawing.published ? "Unpublish" : "Publish",
+                  Css_height: "30px",
+                  css_padding: "2px",
+                  on_mousedown: () =>
+                    drawing.published
+                      ? drawingManager.unpublish(drawing.id, async () => await this.populate())
+                      : drawingManager.publish(drawing.id, async () => await this.populate()),
+                }),
+                new ButtonComponent({
+                  value: "Edit link",
+                  Css_height: "30px",
+                  css_padding: "2px",
+                  on_mousedown: () => drawingManager.createEditLink(drawing.id),
+                }),
                 new ButtonComponent({
                   value: "Rename",
                   Css_height: "30px",
@@ -636,7 +849,7 @@ class UserSignUpComponent extends PopupComponent {
 
 class UserLoginComponent extends PopupComponent {
   css_width = "300px";
-  css_height = "250px";
+  css_height = "330px";
   css_marginLeft = "calc(50vw - 150px)";
 
   disableModes = true;
@@ -660,14 +873,40 @@ class UserLoginComponent extends PopupComponent {
         },
         css_width: "100%",
       }),
+      new ButtonComponent({
+        value: "Email me a login link",
+        css_margin: "10px auto 0 auto",
+        css_display: "block",
+        on_click: async () => await userManager.requestLoginLink(),
+      }),
       new Component({
         css_width: "100%",
-        css_marginTop: "15px",
+        css_marginTop: "10px",
         css_textAlign: "center",
-        value: "Forgot Password? Please visit the Help page.",
+        value: "Forgot Password? Log in with a link, or visit the Help page.",
+      }),
+      new Component({
+        accessibleBy: "providersComponent",
+        css_width: "100%",
+        css_marginTop: "10px",
       }),
     ];
   }
+
+  async populateProviders() {
+    let response = await userManager.getOidcProviders();
+    if (!handleResponse(response, "", true) || response.results.length == 0) return;
+    for (let provider of response.results) {
+      this.providersComponent.addChild(
+        new ButtonComponent({
+          value: `Log in with ${provider.display_name}`,
+          css_margin: "4px auto 0 auto",
+          css_display: "block",
+          on_click: () => (window.location.href = provider.login_url),
+        })
+      );
+    }
+  }
 }
 
 class RightMenuComponent extends MenuComponent {
@@ -748,11 +987,19 @@ async function mainServerClient() {
 
   // Render user related UI
   await userManager.update();
+  await bodyComponent.loginComponent.populateProviders();
 
   // Render drawing related UI
   drawingManager.update();
 
-  routeManager.addRoutes([/^\/(?<shortkey>[\w]+)$/, vars => drawingManager.openFromShortKey(vars.shortkey)]);
+  routeManager.addRoutes(
+    [/^\/p\/(?<token>[\w-]+)$/, vars => drawingManager.openPublished(vars.token)],
+    [/^\/e\/(?<token>[\w-]+)$/, vars => drawingManager.openFromEditLink(vars.token)],
+    [/^\/l\/(?<token>[\w-]+)$/, vars => userManager.openLoginLink(vars.token)],
+    [/^\/m\/(?<token>[\w.-]+)$/, vars => userManager.openMfaLogin(vars.token)],
+    [/^\/i\/(?<code>\w+)$/, vars => userManager.openInvite(vars.code)],
+    [/^\/(?<shortkey>[\w-]+)$/, vars => drawingManager.openFromShortKey(vars.shortkey)],
+  );
   routeManager.handle();
 }
 
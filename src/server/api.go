@@ -3,10 +3,18 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -22,13 +30,16 @@ type GenericResponse struct {
 }
 
 type UserResponse struct {
-	Id    int    `json:"id"`
-	Email string `json:"email"`
+	Id          int    `json:"id"`
+	Email       string `json:"email"`
+	Verified    bool   `json:"verified"`
+	TotpEnabled bool   `json:"totp_enabled"`
 }
 
 type CreateUserRequest struct {
-	Email    string `json:"email" validate:"required"`
-	Password string `json:"password" validate:"required"`
+	Email      string `json:"email" validate:"required"`
+	Password   string `json:"password" validate:"required"`
+	InviteCode string `json:"invite_code"`
 }
 
 type AuthUserRequest struct {
@@ -36,8 +47,99 @@ type AuthUserRequest struct {
 	Password string `json:"password"`
 }
 
+// AuthUserResponse is returned instead of a session for users with 2FA. The
+// token is exchanged, along with a code, for a session at /auth/mfa.
+type AuthUserResponse struct {
+	MfaToken string `json:"mfa_token"`
+}
+
+type MfaAuthRequest struct {
+	MfaToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type BeginTotpResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauth_uri"`
+}
+
+type ConfirmTotpRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type ConfirmTotpResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTotpRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type OidcProviderResponse struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	LoginUrl    string `json:"login_url"`
+}
+
+type ListOidcProvidersResponse struct {
+	Results []OidcProviderResponse `json:"results"`
+}
+
+type LoginLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type RedeemLoginLinkRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	// CurrentPassword is left out by users who don't have one yet.
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email" validate:"required"`
+	Password string `json:"password"`
+}
+
+type DeleteUserRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteUserResponse struct {
+	DeleteAt string `json:"delete_at"`
+}
+
+type DataExportResponse struct {
+	Id          int    `json:"id"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	DownloadUrl string `json:"download_url,omitempty"`
+}
+
 type CreateImmutableDrawingRequest struct {
-	Data string `json:"data" validate:"required,json"`
+	// Data must be JSON, unless an encryption Algorithm is given, in which case
+	// it is the ciphertext.
+	Data      string `json:"data" validate:"required"`
+	Algorithm string `json:"algorithm" validate:"max=50"`
+	// ExpiresIn is a duration such as "24h", and ExpiresAt an RFC 3339 time.
+	ExpiresIn string `json:"expires_in" validate:"excluded_with=ExpiresAt"`
+	ExpiresAt string `json:"expires_at"`
+	MaxViews  int    `json:"max_views" validate:"gte=0"`
+	Password  string `json:"password"`
+}
+
+type UnlockImmutableDrawingRequest struct {
+	Password string `json:"password" validate:"required"`
 }
 
 type CreateImmutableDrawingResponse struct {
@@ -48,38 +150,250 @@ type GetImmutableDrawingResponse struct {
 	Data      string `json:"data"`
 	Hits      int    `json:"hits"`
 	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	MaxViews  int    `json:"max_views,omitempty"`
+}
+
+type GetEncryptedImmutableDrawingResponse struct {
+	Encrypted  bool   `json:"encrypted"`
+	Ciphertext string `json:"ciphertext"`
+	Algorithm  string `json:"algorithm"`
+	Hits       int    `json:"hits"`
+	CreatedAt  string `json:"created_at"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	MaxViews   int    `json:"max_views,omitempty"`
+}
+
+type ClaimSlugRequest struct {
+	Slug     string `json:"slug" validate:"required"`
+	ShortKey string `json:"short_key" validate:"required"`
+}
+
+type UpdateSlugRequest struct {
+	ShortKey string `json:"short_key" validate:"required"`
+}
+
+type SlugHistoryResponse struct {
+	ShortKey   string `json:"short_key"`
+	ReplacedAt string `json:"replaced_at"`
+}
+
+type SlugResponse struct {
+	Slug      string                `json:"slug"`
+	ShortKey  string                `json:"short_key"`
+	CreatedAt string                `json:"created_at"`
+	UpdatedAt string                `json:"updated_at"`
+	History   []SlugHistoryResponse `json:"history"`
 }
 
 type CreateMutableDrawingRequest struct {
-	Data string `json:"data" validate:"required,json"`
-	Name string `json:"name" validate:"required"`
+	Data string   `json:"data" validate:"required,json"`
+	Name string   `json:"name" validate:"required"`
+	Tags []string `json:"tags" validate:"max=50,dive,max=50"`
 }
 
 type CreateMutableDrawingResponse struct {
 	Id int `json:"id"`
 }
 
+type ImportResultResponse struct {
+	File        string `json:"file"`
+	Id          int    `json:"id,omitempty"`
+	DuplicateOf int    `json:"duplicate_of,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type ImportMutableDrawingsResponse struct {
+	Error    string                 `json:"error"`
+	Imported int                    `json:"imported"`
+	Results  []ImportResultResponse `json:"results"`
+}
+
 type UpdateMutableDrawingRequest struct {
 	Data string `json:"data"`
 	Name string `json:"name"`
 }
 
 type GetMutableDrawingResponse struct {
+	Id        int      `json:"id"`
+	UserId    int      `json:"user_id"`
+	Data      string   `json:"data"`
+	Name      string   `json:"name"`
+	CreatedAt string   `json:"created_at"`
+	Tags      []string `json:"tags"`
+	// Where the drawing was duplicated or forked from, if anywhere.
+	ForkedFromId       int    `json:"forked_from_id,omitempty"`
+	ForkedFromShortKey string `json:"forked_from_short_key,omitempty"`
+	PublishToken       string `json:"publish_token,omitempty"`
+}
+
+type MutableDrawingRowResponse struct {
 	Id        int    `json:"id"`
-	UserId    int    `json:"user_id"`
-	Data      string `json:"data"`
 	Name      string `json:"name"`
 	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	FolderId  int    `json:"folder_id,omitempty"`
+	Published bool   `json:"published"`
 }
 
-type MutableDrawingRowResponse struct {
+type CreateEditLinkRequest struct {
+	// ExpiresIn is a duration such as "24h", and ExpiresAt an RFC 3339 time.
+	ExpiresIn string `json:"expires_in" validate:"excluded_with=ExpiresAt"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type CreateEditLinkResponse struct {
+	Id    int    `json:"id"`
+	Token string `json:"token"`
+}
+
+type EditLinkResponse struct {
+	Id        int    `json:"id"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+type ListEditLinksResponse struct {
+	Results []EditLinkResponse `json:"results"`
+}
+
+type GetEditLinkDrawingResponse struct {
 	Id        int    `json:"id"`
+	Data      string `json:"data"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type MutableDrawingHistoryResponse struct {
+	EditedAt string `json:"edited_at"`
+	// Editor is "owner", or "link user" for edits made through an edit link.
+	Editor     string `json:"editor"`
+	EditLinkId int    `json:"edit_link_id,omitempty"`
+}
+
+type CreateInviteRequest struct {
+	// MaxUses defaults to 1, and only admins can make it 0 for unlimited.
+	MaxUses   *int   `json:"max_uses" validate:"omitempty,min=0"`
+	ExpiresIn string `json:"expires_in" validate:"excluded_with=ExpiresAt"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type CreateInviteResponse struct {
+	Id   int    `json:"id"`
+	Code string `json:"code"`
+	Url  string `json:"url"`
+}
+
+type InviteResponse struct {
+	Id       int    `json:"id"`
+	IssuedBy string `json:"issued_by"`
+	// MaxUses is left out for invites without a limit.
+	MaxUses   int      `json:"max_uses,omitempty"`
+	Uses      int      `json:"uses"`
+	ExpiresAt string   `json:"expires_at,omitempty"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+	CreatedAt string   `json:"created_at"`
+	Invitees  []string `json:"invitees"`
+}
+
+type ListInvitesResponse struct {
+	Results []InviteResponse `json:"results"`
+}
+
+type ListMutableDrawingHistoryResponse struct {
+	Results []MutableDrawingHistoryResponse `json:"results"`
+}
+
+type PublishMutableDrawingResponse struct {
+	PublishToken string `json:"publish_token"`
+}
+
+type GetPublishedMutableDrawingResponse struct {
+	Data      string `json:"data"`
 	Name      string `json:"name"`
 	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
 }
 
 type ListMutableDrawingsResponse struct {
-	Results []MutableDrawingRowResponse `json:"results"`
+	Results    []MutableDrawingRowResponse `json:"results"`
+	NextCursor string                      `json:"next_cursor"`
+	Total      int                         `json:"total"`
+}
+
+type TrashedMutableDrawingResponse struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	DeletedAt string `json:"deleted_at"`
+	PurgeAt   string `json:"purge_at"`
+}
+
+type ListTrashResponse struct {
+	Results []TrashedMutableDrawingResponse `json:"results"`
+}
+
+type MoveMutableDrawingRequest struct {
+	// FolderId is 0 to move the drawing out of any folder.
+	FolderId int `json:"folder_id" validate:"gte=0"`
+}
+
+type SearchResultResponse struct {
+	Id        int     `json:"id"`
+	Name      string  `json:"name"`
+	CreatedAt string  `json:"created_at"`
+	Score     float64 `json:"score"`
+	// Highlights are HTML escaped, with matches wrapped in <mark>.
+	NameHighlight string `json:"name_highlight"`
+	TextHighlight string `json:"text_highlight"`
+}
+
+type SearchMutableDrawingsResponse struct {
+	Results []SearchResultResponse `json:"results"`
+}
+
+type TagMutableDrawingRequest struct {
+	Tags []string `json:"tags" validate:"required,max=50,dive,max=50"`
+}
+
+type TagResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type ListTagsResponse struct {
+	Results []TagResponse `json:"results"`
+}
+
+type CreateFolderRequest struct {
+	Name     string `json:"name" validate:"required"`
+	ParentId int    `json:"parent_id" validate:"gte=0"`
+}
+
+type CreateFolderResponse struct {
+	Id int `json:"id"`
+}
+
+type RenameFolderRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type MoveFolderRequest struct {
+	// ParentId is 0 to move the folder to the top level.
+	ParentId int `json:"parent_id" validate:"gte=0"`
+}
+
+type FolderResponse struct {
+	Id        int    `json:"id"`
+	ParentId  int    `json:"parent_id,omitempty"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+}
+
+type ListFoldersResponse struct {
+	Results []FolderResponse `json:"results"`
 }
 
 type AuthHandler struct {
@@ -87,6 +401,13 @@ type AuthHandler struct {
 	HandlerFunc func(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request)
 }
 
+// EditLinkHandler serves requests holding an edit link token rather than a
+// session, which grants access to the one drawing only.
+type EditLinkHandler struct {
+	Servicers   *Servicers
+	HandlerFunc func(db *sql.DB, link EditLinkRow, w http.ResponseWriter, r *http.Request)
+}
+
 type Handler struct {
 	Servicers   *Servicers
 	HandlerFunc func(db *sql.DB, w http.ResponseWriter, r *http.Request)
@@ -97,227 +418,2037 @@ func WriteUnknownError(w http.ResponseWriter, err error) {
 	WriteGenericResponse(w, http.StatusInternalServerError, "Unknown error")
 }
 
-func WriteGenericResponse(w http.ResponseWriter, status int, err string) {
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(GenericResponse{Error: err})
+func WriteGenericResponse(w http.ResponseWriter, status int, err string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(GenericResponse{Error: err})
+}
+
+func WriteStructuredResponse(w http.ResponseWriter, status int, data any) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func DecodeRequest(request any, w http.ResponseWriter, r *http.Request) bool {
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil {
+		validate := validator.New()
+		err = validate.Struct(request)
+		if err == nil {
+			return true
+		}
+	}
+	WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+	return false
+}
+
+// ParseExpiry resolves either a relative or absolute expiry into a time, which
+// is nil if neither is given. It fails if the expiry is malformed or not in the
+// future.
+func ParseExpiry(expiresIn string, expiresAt string) (*time.Time, error) {
+	var expiry time.Time
+	switch {
+	case expiresIn != "":
+		duration, err := time.ParseDuration(expiresIn)
+		if err != nil {
+			return nil, err
+		}
+		expiry = time.Now().Add(duration)
+	case expiresAt != "":
+		parsed, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		expiry = parsed
+	default:
+		return nil, nil
+	}
+	if !expiry.After(time.Now()) {
+		return nil, errors.New("expiry is not in the future")
+	}
+	return &expiry, nil
+}
+
+func (handler AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if ProxyAuth != nil {
+		if email, ok := ProxyAuth.UserEmail(r); ok {
+			userId, err := GetOrCreateProxyUser(handler.Servicers.db, email)
+			if err != nil {
+				WriteUnknownError(w, err)
+				return
+			}
+			handler.HandlerFunc(handler.Servicers.db, userId, w, r)
+			return
+		}
+	}
+	sessionCookie, err := r.Cookie("sessionKey")
+	if err != nil {
+		WriteGenericResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userId, err := GetSessionUserId(handler.Servicers.db, sessionCookie.Value)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if userId > -1 {
+		newKey, err := RefreshSession(handler.Servicers.db, sessionCookie.Value)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if newKey != "" {
+			SetSessionCookie(w, newKey)
+		}
+		handler.HandlerFunc(handler.Servicers.db, userId, w, r)
+		return
+	}
+	WriteGenericResponse(w, http.StatusUnauthorized, "Unauthorized")
+}
+
+func (handler EditLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	link, err := GetEditLink(handler.Servicers.db, mux.Vars(r)["token"])
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if link.Id > 0 {
+		handler.HandlerFunc(handler.Servicers.db, link, w, r)
+		return
+	}
+	WriteGenericResponse(w, http.StatusUnauthorized, "Unauthorized")
+}
+
+func (handler Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	handler.HandlerFunc(handler.Servicers.db, w, r)
+}
+
+func IsValidEmail(email string) bool {
+	parsedEmail, err := mail.ParseAddress(email)
+	return err == nil && parsedEmail.Address == email
+}
+
+func SetSessionCookie(w http.ResponseWriter, sessionKey string) {
+	cookie := &http.Cookie{
+		Name:     "sessionKey",
+		Value:    sessionKey,
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Now().Add(31536000 * time.Second), // 1 Year
+		Secure:   IsProd(),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+}
+
+// StartSession logs the user in, however they proved who they are.
+func StartSession(db *sql.DB, userId int, w http.ResponseWriter) error {
+	if _, err := CancelUserDeletion(db, userId); err != nil {
+		return err
+	}
+	sessionKey, err := CreateSession(db, userId)
+	if err != nil {
+		return err
+	}
+	SetSessionCookie(w, sessionKey)
+	return nil
+}
+
+// RotateSessionCookie gives the request's session a new key, after what it
+// can do has changed, and returns it. Users logged in by the proxy have no
+// session to rotate.
+func RotateSessionCookie(db *sql.DB, w http.ResponseWriter, r *http.Request) (string, error) {
+	sessionCookie, err := r.Cookie("sessionKey")
+	if err != nil {
+		return "", nil
+	}
+	key, err := RotateSession(db, sessionCookie.Value)
+	if key != "" {
+		SetSessionCookie(w, key)
+	}
+	return key, err
+}
+
+// CheckReauthentication makes sure it's the user asking, before what they
+// can't undo or what would let someone else take over their account, writing
+// the response if not. Users with a password give it again, and those without
+// one must have logged in recently, or be logged in by the proxy.
+func CheckReauthentication(
+	db *sql.DB, userId int, password string, w http.ResponseWriter, r *http.Request,
+) bool {
+	hasPassword, err := HasPassword(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return false
+	}
+	if hasPassword {
+		correct, err := CheckUserPassword(db, userId, password)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return false
+		}
+		if !correct {
+			WriteGenericResponse(w, http.StatusUnauthorized, "Incorrect password")
+		}
+		return correct
+	}
+	// The proxy vouches for every request it sends.
+	if ProxyAuth != nil {
+		if _, ok := ProxyAuth.UserEmail(r); ok {
+			return true
+		}
+	}
+	recent := false
+	if sessionCookie, err := r.Cookie("sessionKey"); err == nil {
+		recent, err = IsSessionRecent(db, sessionCookie.Value)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return false
+		}
+	}
+	if !recent {
+		WriteGenericResponse(w, http.StatusUnauthorized, "Log in again to do this")
+	}
+	return recent
+}
+
+func ClearSessionCookie(w http.ResponseWriter) {
+	cookie := &http.Cookie{
+		Name:     "sessionKey",
+		Value:    "",
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		Secure:   IsProd(),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+}
+
+func CreateUserHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request CreateUserRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if problem := CheckNewPassword(request.Password); problem != "" {
+		WriteGenericResponse(w, http.StatusOK, problem)
+		return
+	}
+	if !IsValidEmail(request.Email) {
+		WriteGenericResponse(w, http.StatusOK, "Invalid email")
+		return
+	}
+	// An invite gets anyone in, unless registration is closed altogether.
+	// Who can sign up is settled before saying whether the user exists, so
+	// those who can't can't find out who has an account.
+	invited := request.InviteCode != ""
+	needsInvite := RegistrationMode == RegistrationInvite ||
+		(RegistrationMode == RegistrationDomain && !IsRegistrationDomain(request.Email))
+	switch {
+	case RegistrationMode == RegistrationClosed:
+		WriteGenericResponse(w, http.StatusForbidden, "Registration is closed")
+		return
+	case RegistrationMode == RegistrationDomain && needsInvite && !invited:
+		WriteGenericResponse(w, http.StatusForbidden, "Email domain not allowed, an invite is needed to sign up")
+		return
+	case RegistrationMode == RegistrationInvite && !invited:
+		WriteGenericResponse(w, http.StatusForbidden, "An invite is needed to sign up")
+		return
+	}
+	if needsInvite {
+		usable, err := IsInviteUsable(db, request.InviteCode)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if !usable {
+			WriteGenericResponse(w, http.StatusForbidden, "Invalid or expired invite")
+			return
+		}
+	}
+	exists, err := UserExists(db, request.Email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if exists {
+		WriteGenericResponse(w, http.StatusOK, "User already exists")
+		return
+	}
+	userId := -1
+	if invited {
+		userId, err = CreateInvitedUser(db, request.Email, request.Password, request.InviteCode)
+	}
+	// Those who didn't need the invite still get in if it's no good, just
+	// without it counting as used.
+	if err == nil && userId == -1 && !needsInvite {
+		userId, err = CreateUser(db, request.Email, request.Password)
+	}
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if userId == -1 {
+		WriteGenericResponse(w, http.StatusForbidden, "Invalid or expired invite")
+		return
+	}
+	if _, err := ClaimVerificationMail(db, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if err := SendVerificationMail(userId, request.Email); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusCreated, "")
+}
+
+func SendVerificationMail(userId int, email string) error {
+	token := MakeSignedToken(
+		"verify-email", fmt.Sprintf("%d %s", userId, email), time.Now().Add(48*time.Hour),
+	)
+	return DefaultMailer.Send(Mail{
+		To:      email,
+		Subject: "Verify your cascii email",
+		Body: "Follow this link within 48 hours to verify your cascii email:\n\n" +
+			BaseUrl + "/api/user/verify?token=" + token,
+	})
+}
+
+func VerifyEmailHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	value, ok := ParseSignedToken("verify-email", r.URL.Query().Get("token"))
+	userIdPart, email, _ := strings.Cut(value, " ")
+	userId, err := strconv.Atoi(userIdPart)
+	if !ok || err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid or expired link")
+		return
+	}
+	verified, err := VerifyUserEmail(db, userId, email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !verified {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid or expired link")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+// ResendVerificationHandler sends another verification link to the email if
+// it belongs to an unverified user. The response is the same either way, so
+// it can't be used to find out who has an account.
+func ResendVerificationHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request ResendVerificationRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	userId, err := GetUnverifiedUserId(db, request.Email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// Whether or not a mail is sent, the response is the same.
+	if userId != -1 {
+		claimed, err := ClaimVerificationMail(db, userId)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if claimed {
+			if err := SendVerificationMail(userId, request.Email); err != nil {
+				WriteUnknownError(w, err)
+				return
+			}
+		}
+	}
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+func GetUserHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	email, err := GetUserById(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if email == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+	verified, err := IsUserVerified(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	totp, err := GetTotpState(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, UserResponse{
+		Id:          userId,
+		Email:       email,
+		Verified:    verified,
+		TotpEnabled: totp.Enabled,
+	})
+}
+
+func AuthUserHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request AuthUserRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	userId, err := Authenticate(db, request.Email, request.Password)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if userId == -1 {
+		WriteGenericResponse(w, http.StatusOK, "User not found")
+		return
+	}
+	if RequireVerifiedEmail {
+		verified, err := IsUserVerified(db, userId)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if !verified {
+			WriteGenericResponse(w, http.StatusForbidden, "Email not verified")
+			return
+		}
+	}
+	CompleteLogin(db, userId, w)
+}
+
+// CompleteLogin starts a session for a user who has proven who they are,
+// unless they have 2FA, in which case they're given a token to complete their
+// login with a code.
+func CompleteLogin(db *sql.DB, userId int, w http.ResponseWriter) {
+	totp, err := GetTotpState(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if totp.Enabled {
+		token := MakeSignedToken("mfa", strconv.Itoa(userId), time.Now().Add(5*time.Minute))
+		WriteStructuredResponse(w, http.StatusAccepted, AuthUserResponse{MfaToken: token})
+		return
+	}
+	if err := StartSession(db, userId, w); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+func MfaAuthHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request MfaAuthRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	value, ok := ParseSignedToken("mfa", request.MfaToken)
+	userId, err := strconv.Atoi(value)
+	if !ok || err != nil {
+		WriteGenericResponse(w, http.StatusUnauthorized, "Login expired, please try again")
+		return
+	}
+	if !CheckTotpCodeResponse(db, userId, request.Code, w) {
+		return
+	}
+	if err := StartSession(db, userId, w); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+// CheckTotpCodeResponse checks the user's code, responding if it isn't right.
+func CheckTotpCodeResponse(db *sql.DB, userId int, code string, w http.ResponseWriter) bool {
+	ok, locked, err := CheckTotpCode(db, userId, code)
+	switch {
+	case err != nil:
+		WriteUnknownError(w, err)
+	case locked:
+		WriteGenericResponse(w, http.StatusTooManyRequests, "Too many attempts, try again later")
+	case !ok:
+		WriteGenericResponse(w, http.StatusUnauthorized, "Invalid code")
+	}
+	return err == nil && ok
+}
+
+func BeginTotpHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	totp, err := GetTotpState(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if totp.Enabled {
+		WriteGenericResponse(w, http.StatusBadRequest, "Two-factor authentication already enabled")
+		return
+	}
+	email, err := GetUserById(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	secret, err := BeginTotpEnrollment(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, BeginTotpResponse{
+		Secret:     secret,
+		OtpauthUri: TotpUri(email, secret),
+	})
+}
+
+func ConfirmTotpHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request ConfirmTotpRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	codes, err := ConfirmTotpEnrollment(db, userId, request.Code)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if codes == nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	if _, err := RotateSessionCookie(db, w, r); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// The codes are only ever shown now, as only their hashes are kept.
+	WriteStructuredResponse(w, http.StatusOK, ConfirmTotpResponse{RecoveryCodes: codes})
+}
+
+func DisableTotpHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request DisableTotpRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	totp, err := GetTotpState(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !totp.Enabled {
+		WriteGenericResponse(w, http.StatusBadRequest, "Two-factor authentication not enabled")
+		return
+	}
+	if !CheckReauthentication(db, userId, request.Password, w, r) {
+		return
+	}
+	if !CheckTotpCodeResponse(db, userId, request.Code, w) {
+		return
+	}
+	if err := DisableTotp(db, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if _, err := RotateSessionCookie(db, w, r); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func ListOidcProvidersHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	results := []OidcProviderResponse{}
+	for _, provider := range OidcProviders {
+		results = append(results, OidcProviderResponse{
+			Name:        provider.Name,
+			DisplayName: provider.DisplayName,
+			LoginUrl:    "/api/user/oidc/" + url.PathEscape(provider.Name) + "/login",
+		})
+	}
+	slices.SortFunc(results, func(a, b OidcProviderResponse) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	WriteStructuredResponse(w, http.StatusOK, ListOidcProvidersResponse{Results: results})
+}
+
+// OidcLoginHandler sends the user to log in with the provider. What's needed
+// to check the login they come back with is kept in a signed cookie.
+func OidcLoginHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	provider, ok := OidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		WriteGenericResponse(w, http.StatusNotFound, "Provider not found")
+		return
+	}
+	state := RandomBase62(32)
+	nonce := RandomBase62(32)
+	verifier := RandomBase62(64)
+	authUrl, err := provider.AuthCodeUrl(state, nonce, verifier)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: "oidcLogin",
+		Value: MakeSignedToken(
+			"oidc",
+			strings.Join([]string{provider.Name, state, nonce, verifier}, " "),
+			time.Now().Add(10*time.Minute),
+		),
+		HttpOnly: true,
+		Path:     "/api/user/oidc",
+		MaxAge:   600,
+		Secure:   IsProd(),
+		// Lax, as it has to come back with the provider's redirect.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+func OidcCallbackHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	provider, ok := OidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		WriteGenericResponse(w, http.StatusNotFound, "Provider not found")
+		return
+	}
+	var login []string
+	if cookie, err := r.Cookie("oidcLogin"); err == nil {
+		value, _ := ParseSignedToken("oidc", cookie.Value)
+		login = strings.Split(value, " ")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: "oidcLogin", Value: "", Path: "/api/user/oidc", MaxAge: -1,
+	})
+	query := r.URL.Query()
+	if len(login) != 4 || login[0] != provider.Name || query.Get("state") != login[1] {
+		WriteGenericResponse(w, http.StatusBadRequest, "Login expired, please try again")
+		return
+	}
+	if query.Get("error") != "" || query.Get("code") == "" {
+		WriteGenericResponse(w, http.StatusUnauthorized, "Login failed")
+		return
+	}
+	claims, err := provider.Exchange(query.Get("code"), login[3], login[2])
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %s", provider.Name, err)
+		WriteGenericResponse(w, http.StatusUnauthorized, "Login failed")
+		return
+	}
+	userId, err := ResolveOidcUser(db, provider, claims)
+	switch {
+	case errors.Is(err, ErrOidcDomainNotAllowed):
+		WriteGenericResponse(w, http.StatusForbidden, "Email domain not allowed")
+		return
+	case errors.Is(err, ErrOidcEmailNotVerified):
+		WriteGenericResponse(w, http.StatusForbidden, "Email not verified")
+		return
+	case errors.Is(err, ErrOidcNoAccount):
+		WriteGenericResponse(w, http.StatusForbidden, "No account for this email")
+		return
+	case err != nil:
+		WriteUnknownError(w, err)
+		return
+	}
+
+	next := "/"
+	totp, err := GetTotpState(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if totp.Enabled {
+		// The frontend asks for their code to finish logging in.
+		next = "/m/" + MakeSignedToken("mfa", strconv.Itoa(userId), time.Now().Add(5*time.Minute))
+	} else if err := StartSession(db, userId, w); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// Browsers don't send SameSite=Strict cookies, like the session, along a
+	// chain of redirects started by another site. Navigating from a page of
+	// our own means the session is there on arrival.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(
+		w,
+		`<!DOCTYPE html><meta http-equiv="refresh" content="0;url=%s"><a href="%s">Continue</a>`,
+		html.EscapeString(next),
+		html.EscapeString(next),
+	)
+}
+
+// RequestLoginLinkHandler emails a login link to the user with the email. The
+// response is the same whether or not there is one.
+func RequestLoginLinkHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request LoginLinkRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	userId, err := GetUserIdByEmail(db, request.Email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if userId != -1 {
+		token, err := CreateLoginLink(db, userId)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		// Whether or not a link is sent, the response is the same.
+		if token == "" {
+			WriteGenericResponse(w, http.StatusAccepted, "")
+			return
+		}
+		if err := DefaultMailer.Send(Mail{
+			To:      request.Email,
+			Subject: "Your cascii login link",
+			Body: fmt.Sprintf(
+				"Follow this link within %d minutes to log in to cascii. It only works once.\n\n%s/l/%s",
+				int(LoginLinkLifetime.Minutes()), BaseUrl, token,
+			),
+		}); err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+	}
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+// RedeemLoginLinkHandler logs in with a login link. The link itself opens the
+// frontend, which posts its token here, so that mail scanners following links
+// don't use it up.
+func RedeemLoginLinkHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request RedeemLoginLinkRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	userId, err := RedeemLoginLink(db, request.Token)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if userId == -1 {
+		WriteGenericResponse(w, http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+	CompleteLogin(db, userId, w)
+}
+
+func LogoutUserHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	if err := DeleteSession(db, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	ClearSessionCookie(w)
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func ChangePasswordHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request ChangePasswordRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if problem := CheckNewPassword(request.NewPassword); problem != "" {
+		WriteGenericResponse(w, http.StatusOK, problem)
+		return
+	}
+	if !CheckReauthentication(db, userId, request.CurrentPassword, w, r) {
+		return
+	}
+	if err := SetUserPassword(db, userId, request.NewPassword); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	sessionKey, err := RotateSessionCookie(db, w, r)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// Anyone else logged in as the user, with the old password, is logged out.
+	if err := DeleteOtherSessions(db, userId, sessionKey); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func ChangeEmailHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request ChangeEmailRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if !IsValidEmail(request.Email) {
+		WriteGenericResponse(w, http.StatusOK, "Invalid email")
+		return
+	}
+	if !CheckReauthentication(db, userId, request.Password, w, r) {
+		return
+	}
+	exists, err := UserExists(db, request.Email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if exists {
+		WriteGenericResponse(w, http.StatusOK, "User already exists")
+		return
+	}
+	if err := SetPendingEmail(db, userId, request.Email); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// The email only changes once the link sent to it is followed.
+	token := MakeSignedToken(
+		"email-change", fmt.Sprintf("%d %s", userId, request.Email), time.Now().Add(24*time.Hour),
+	)
+	if err := DefaultMailer.Send(Mail{
+		To:      request.Email,
+		Subject: "Confirm your new cascii email",
+		Body: "Follow this link within 24 hours to change your cascii email to this one:\n\n" +
+			BaseUrl + "/api/user/email/verify?token=" + token,
+	}); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+func VerifyEmailChangeHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	value, ok := ParseSignedToken("email-change", r.URL.Query().Get("token"))
+	userIdPart, email, _ := strings.Cut(value, " ")
+	userId, err := strconv.Atoi(userIdPart)
+	if !ok || err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid or expired link")
+		return
+	}
+	changed, err := ConfirmEmailChange(db, userId, email)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !changed {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid or expired link")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func DeleteUserHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request DeleteUserRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if !CheckReauthentication(db, userId, request.Password, w, r) {
+		return
+	}
+	deleteAt, err := ScheduleUserDeletion(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// Logging back in before then cancels the deletion.
+	if err := DeleteSession(db, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	ClearSessionCookie(w)
+	WriteStructuredResponse(w, http.StatusAccepted, DeleteUserResponse{DeleteAt: deleteAt})
+}
+
+func MakeDataExportResponse(export DataExportRow) DataExportResponse {
+	response := DataExportResponse{
+		Id:          export.Id,
+		Status:      export.Status,
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: export.CompletedAt.String,
+		ExpiresAt:   export.ExpiresAt.String,
+	}
+	if export.Status == "ready" {
+		response.DownloadUrl = fmt.Sprintf("/api/user/data-export/%d/download", export.Id)
+	}
+	return response
+}
+
+func CreateDataExportHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := CreateDataExport(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	export, err := GetDataExport(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusAccepted, MakeDataExportResponse(export))
+}
+
+func GetDataExportHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	export, err := GetDataExport(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if export.Id == 0 {
+		WriteGenericResponse(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, MakeDataExportResponse(export))
+}
+
+func DownloadDataExportHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	export, err := GetDataExport(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if export.Id == 0 || export.Status != "ready" {
+		WriteGenericResponse(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	file, err := os.Open(filepath.Join(DataExportDir, export.FileName.String))
+	if os.IsNotExist(err) {
+		WriteGenericResponse(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="cascii-data.zip"`)
+	http.ServeContent(w, r, "cascii-data.zip", info.ModTime(), file)
+}
+
+func CreateImmutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var request CreateImmutableDrawingRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if request.Algorithm == "" && !json.Valid([]byte(request.Data)) {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	expiresAt, err := ParseExpiry(request.ExpiresIn, request.ExpiresAt)
+	if err != nil {
+		WriteGenericResponse(w, http.StatusOK, "Invalid expiry")
+		return
+	}
+	shortKey, err := CreateImmutableDrawing(
+		db,
+		request.Data,
+		ImmutableDrawingOptions{
+			ExpiresAt: expiresAt,
+			MaxViews:  request.MaxViews,
+			Password:  request.Password,
+			Algorithm: request.Algorithm,
+		},
+	)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, CreateImmutableDrawingResponse{ShortKey: shortKey})
+}
+
+// ViewImmutableDrawing resolves the drawing of the request's short key (or
+// slug) and counts a view of it, as long as it may be viewed. Otherwise the
+// reason why not is written, and it returns false.
+func ViewImmutableDrawing(db *sql.DB, w http.ResponseWriter, r *http.Request) (string, ImmutableDrawingRow, bool) {
+	shortKey, drawing, err := ResolveImmutableDrawing(db, mux.Vars(r)["short_key"])
+	if err != nil {
+		WriteUnknownError(w, err)
+		return shortKey, drawing, false
+	}
+	if drawing.Data == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return shortKey, drawing, false
+	}
+	if drawing.Gone {
+		WriteGenericResponse(w, http.StatusGone, "Drawing expired")
+		return shortKey, drawing, false
+	}
+	if drawing.Password.Valid {
+		accessCookie, err := r.Cookie("drawingAccess")
+		if err != nil || !CheckImmutableDrawingAccessToken(shortKey, accessCookie.Value) {
+			WriteGenericResponse(w, http.StatusUnauthorized, "Password required")
+			return shortKey, drawing, false
+		}
+	}
+
+	// For most drawings this is just a side effect, so if it fails, don't worry
+	// so much but log. For those with a view limit, it's what enforces it.
+	counted, err := IncrementImmutableDrawingHits(db, shortKey)
+	switch {
+	case err != nil && drawing.MaxViews.Valid:
+		WriteUnknownError(w, err)
+		return shortKey, drawing, false
+	case err != nil:
+		log.Print(err)
+	case !counted:
+		// Someone else used up the last view, or it expired, in the meantime.
+		WriteGenericResponse(w, http.StatusGone, "Drawing expired")
+		return shortKey, drawing, false
+	default:
+		drawing.Hits++
+	}
+	return shortKey, drawing, true
+}
+
+func GetImmutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	_, drawing, ok := ViewImmutableDrawing(db, w, r)
+	if !ok {
+		return
+	}
+	if drawing.Algorithm.Valid {
+		WriteStructuredResponse(w, http.StatusOK, GetEncryptedImmutableDrawingResponse{
+			Encrypted:  true,
+			Ciphertext: drawing.Data,
+			Algorithm:  drawing.Algorithm.String,
+			Hits:       drawing.Hits,
+			CreatedAt:  drawing.CreatedAt,
+			ExpiresAt:  drawing.ExpiresAt.String,
+			MaxViews:   int(drawing.MaxViews.Int64),
+		})
+		return
+	}
+	response := GetImmutableDrawingResponse{
+		Data:      drawing.Data,
+		Hits:      drawing.Hits,
+		CreatedAt: drawing.CreatedAt,
+		ExpiresAt: drawing.ExpiresAt.String,
+		MaxViews:  int(drawing.MaxViews.Int64),
+	}
+	WriteStructuredResponse(w, http.StatusOK, response)
+}
+
+func UnlockImmutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["short_key"]
+	var request UnlockImmutableDrawingRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	shortKey, drawing, err := ResolveImmutableDrawing(db, key)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Data == "" || !drawing.Password.Valid {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	if drawing.Gone {
+		WriteGenericResponse(w, http.StatusGone, "Drawing expired")
+		return
+	}
+	correct, locked, err := CheckImmutableDrawingPassword(db, shortKey, request.Password)
+	switch {
+	case err != nil:
+		WriteUnknownError(w, err)
+		return
+	case locked:
+		WriteGenericResponse(w, http.StatusTooManyRequests, "Too many attempts, try again later")
+		return
+	case !correct:
+		WriteGenericResponse(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+	expires := time.Now().Add(immutableDrawingAccessTTL)
+	cookie := &http.Cookie{
+		Name:  "drawingAccess",
+		Value: MakeImmutableDrawingAccessToken(shortKey, expires),
+		// Scoping the path means the cookie is only ever sent for this drawing.
+		Path:     "/api/drawings/immutable/" + key,
+		HttpOnly: true,
+		Expires:  expires,
+		Secure:   IsProd(),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+	WriteGenericResponse(w, http.StatusAccepted, "")
+}
+
+func ClaimSlugHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request ClaimSlugRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if !IsValidSlug(request.Slug) {
+		WriteGenericResponse(w, http.StatusOK, "Invalid slug")
+		return
+	}
+	if IsReservedSlug(request.Slug) {
+		WriteGenericResponse(w, http.StatusOK, "Slug is reserved")
+		return
+	}
+	// Short keys take precedence over slugs, so one can't be claimed as a slug.
+	existing, err := GetImmutableDrawing(db, request.Slug)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if existing.Data != "" {
+		WriteGenericResponse(w, http.StatusOK, "Slug already taken")
+		return
+	}
+	drawing, err := GetImmutableDrawing(db, request.ShortKey)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Data == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	created, err := CreateSlug(db, request.Slug, request.ShortKey, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !created {
+		WriteGenericResponse(w, http.StatusOK, "Slug already taken")
+		return
+	}
+	WriteGenericResponse(w, http.StatusCreated, "")
+}
+
+func UpdateSlugHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	var request UpdateSlugRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	drawing, err := GetImmutableDrawing(db, request.ShortKey)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Data == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	updated, err := RepointSlug(db, slug, request.ShortKey, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !updated {
+		WriteGenericResponse(w, http.StatusNotFound, "Slug not found")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func GetSlugHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	row, err := GetSlug(db, slug, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if row.ShortKey == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Slug not found")
+		return
+	}
+	history, err := ListSlugHistory(db, slug)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	historyResponse := []SlugHistoryResponse{}
+	for _, item := range history {
+		historyResponse = append(
+			historyResponse,
+			SlugHistoryResponse{ShortKey: item.ShortKey, ReplacedAt: item.ReplacedAt},
+		)
+	}
+	WriteStructuredResponse(w, http.StatusOK, SlugResponse{
+		Slug:      slug,
+		ShortKey:  row.ShortKey,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		History:   historyResponse,
+	})
+}
+
+func CreateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request CreateMutableDrawingRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+
+	if len(request.Name) > 100 {
+		WriteGenericResponse(w, http.StatusOK, "Name too long")
+		return
+	}
+
+	id, err := CreateMutableDrawing(db, request.Data, request.Name, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if _, err := AddMutableDrawingTags(db, id, request.Tags, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusCreated, CreateMutableDrawingResponse{Id: id})
+}
+
+// ImportMutableDrawingsHandler imports cascii JSON files, uploaded as "files"
+// either directly or zipped up. Every file must be valid, otherwise nothing is
+// imported and the errors are reported per file.
+func ImportMutableDrawingsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImportSize)
+	if err := r.ParseMultipartForm(MaxImportSize); err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	var uploads []ImportUpload
+	for _, header := range r.MultipartForm.File["files"] {
+		file, err := header.Open()
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		defer file.Close()
+		uploads = append(uploads, ImportUpload{Name: header.Filename, Reader: file})
+	}
+	files, err := ReadImportFiles(uploads)
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Invalid import: "+err.Error())
+		return
+	}
+	if len(files) == 0 {
+		WriteGenericResponse(w, http.StatusBadRequest, "Nothing to import")
+		return
+	}
+
+	// The same rules as creating a drawing one at a time.
+	validate := validator.New()
+	resultsResponse := []ImportResultResponse{}
+	valid := true
+	for _, file := range files {
+		result := ImportResultResponse{File: file.File}
+		request := CreateMutableDrawingRequest{Data: file.Data, Name: file.Name, Tags: file.Tags}
+		if err := validate.Struct(request); err != nil {
+			result.Error = "Invalid drawing"
+		} else if len(request.Name) > 100 {
+			result.Error = "Name too long"
+		}
+		valid = valid && result.Error == ""
+		resultsResponse = append(resultsResponse, result)
+	}
+	if !valid {
+		WriteStructuredResponse(w, http.StatusBadRequest, ImportMutableDrawingsResponse{
+			Error:   "Nothing imported, some files are invalid",
+			Results: resultsResponse,
+		})
+		return
+	}
+
+	results, err := ImportMutableDrawings(db, files, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	imported := 0
+	for i, item := range results {
+		resultsResponse[i].Id = item.Id
+		resultsResponse[i].DuplicateOf = item.DuplicateOf
+		if item.Id > 0 {
+			imported++
+		}
+	}
+	WriteStructuredResponse(w, http.StatusCreated, ImportMutableDrawingsResponse{
+		Imported: imported,
+		Results:  resultsResponse,
+	})
+}
+
+func GetMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	drawing, err := GetMutableDrawing(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Name == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	tags, err := GetMutableDrawingTags(db, id)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, GetMutableDrawingResponse{
+		Id:                 id,
+		UserId:             userId,
+		Data:               drawing.Data,
+		Name:               drawing.Name,
+		CreatedAt:          drawing.CreatedAt,
+		Tags:               tags,
+		ForkedFromId:       int(drawing.ForkedFromId.Int64),
+		ForkedFromShortKey: drawing.ForkedFromShortKey.String,
+		PublishToken:       drawing.PublishToken.String,
+	})
+}
+
+func DuplicateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	newId, err := DuplicateMutableDrawing(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if newId == -1 {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	WriteStructuredResponse(w, http.StatusCreated, CreateMutableDrawingResponse{Id: newId})
+}
+
+func ForkImmutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	// Forking is as good as viewing, so the same rules apply.
+	shortKey, drawing, ok := ViewImmutableDrawing(db, w, r)
+	if !ok {
+		return
+	}
+	if drawing.Algorithm.Valid {
+		WriteGenericResponse(w, http.StatusBadRequest, "Encrypted drawings can't be forked")
+		return
+	}
+	id, err := ForkImmutableDrawing(db, shortKey, mux.Vars(r)["short_key"], drawing.Data, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if id == -1 {
+		// It expired or was purged since it was viewed just now.
+		WriteGenericResponse(w, http.StatusGone, "Drawing expired")
+		return
+	}
+	WriteStructuredResponse(w, http.StatusCreated, CreateMutableDrawingResponse{Id: id})
+}
+
+func PublishMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	// Publishing again regenerates the token, so old links stop working.
+	token, err := PublishMutableDrawing(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if token == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, PublishMutableDrawingResponse{PublishToken: token})
+}
+
+func UnpublishMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	unpublished, err := UnpublishMutableDrawing(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !unpublished {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not published")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func GetPublishedMutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	drawing, err := GetPublishedMutableDrawing(db, mux.Vars(r)["token"])
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Name == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	// The link always shows the latest saved version.
+	w.Header().Set("Cache-Control", "no-store")
+	WriteStructuredResponse(w, http.StatusOK, GetPublishedMutableDrawingResponse{
+		Data:      drawing.Data,
+		Name:      drawing.Name,
+		CreatedAt: drawing.CreatedAt,
+		UpdatedAt: drawing.UpdatedAt,
+	})
+}
+
+func UpdateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	ApplyMutableDrawingUpdate(db, id, userId, 0, w, r)
+}
+
+// ApplyMutableDrawingUpdate updates the drawing from the request, whether made
+// by its owner or through an edit link (editLinkId is 0 for the owner).
+func ApplyMutableDrawingUpdate(
+	db *sql.DB, id int, userId int, editLinkId int, w http.ResponseWriter, r *http.Request,
+) {
+	var request UpdateMutableDrawingRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if len(request.Name) > 100 {
+		WriteGenericResponse(w, http.StatusOK, "Name too long")
+		return
+	}
+	updated, err := UpdateMutableDrawing(db, id, request.Data, request.Name, userId, editLinkId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !updated {
+		WriteGenericResponse(w, http.StatusNotAcceptable, "Nothing to update")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func CreateEditLinkHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var request CreateEditLinkRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	expiresAt, err := ParseExpiry(request.ExpiresIn, request.ExpiresAt)
+	if err != nil {
+		WriteGenericResponse(w, http.StatusOK, "Invalid expiry")
+		return
+	}
+	linkId, token, err := CreateEditLink(db, id, userId, expiresAt)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if token == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	// The token is only ever available here, as just its hash is kept.
+	WriteStructuredResponse(w, http.StatusCreated, CreateEditLinkResponse{Id: linkId, Token: token})
+}
+
+func ListEditLinksHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	results, err := ListEditLinks(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	resultsResponse := []EditLinkResponse{}
+	for _, item := range results {
+		resultsResponse = append(
+			resultsResponse,
+			EditLinkResponse{
+				Id:        item.Id,
+				CreatedAt: item.CreatedAt,
+				ExpiresAt: item.ExpiresAt.String,
+				RevokedAt: item.RevokedAt.String,
+			},
+		)
+	}
+	WriteStructuredResponse(w, http.StatusOK, ListEditLinksResponse{Results: resultsResponse})
+}
+
+func RevokeEditLinkHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err1 := strconv.Atoi(mux.Vars(r)["id"])
+	linkId, err2 := strconv.Atoi(mux.Vars(r)["link_id"])
+	if err1 != nil || err2 != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	revoked, err := RevokeEditLink(db, linkId, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !revoked {
+		WriteGenericResponse(w, http.StatusNotFound, "Edit link not found")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func CreateInviteHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request CreateInviteRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	if RegistrationMode == RegistrationClosed {
+		WriteGenericResponse(w, http.StatusForbidden, "Registration is closed")
+		return
+	}
+	expiresAt, err := ParseExpiry(request.ExpiresIn, request.ExpiresAt)
+	if err != nil {
+		WriteGenericResponse(w, http.StatusOK, "Invalid expiry")
+		return
+	}
+	admin, err := IsAdmin(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	maxUses := 1
+	if request.MaxUses != nil {
+		maxUses = *request.MaxUses
+	}
+	if !admin && (maxUses == 0 || maxUses > MaxUserInviteUses) {
+		WriteGenericResponse(w, http.StatusOK, fmt.Sprintf("Invites can be used at most %d times", MaxUserInviteUses))
+		return
+	}
+	var limit *int
+	if maxUses != 0 {
+		limit = &maxUses
+	}
+	id, code, err := CreateInvite(db, userId, limit, expiresAt)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	// The code is only ever available here, as just its hash is kept.
+	WriteStructuredResponse(w, http.StatusCreated, CreateInviteResponse{
+		Id:   id,
+		Code: code,
+		Url:  BaseUrl + "/i/" + code,
+	})
+}
+
+func ListInvitesHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "true"
+	if all {
+		admin, err := IsAdmin(db, userId)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if !admin {
+			WriteGenericResponse(w, http.StatusForbidden, "Only admins can list all invites")
+			return
+		}
+	}
+	results, err := ListInvites(db, userId, all)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	resultsResponse := []InviteResponse{}
+	for _, item := range results {
+		invitees := item.Invitees
+		if invitees == nil {
+			invitees = []string{}
+		}
+		resultsResponse = append(
+			resultsResponse,
+			InviteResponse{
+				Id:        item.Id,
+				IssuedBy:  item.IssuedBy,
+				MaxUses:   int(item.MaxUses.Int64),
+				Uses:      item.Uses,
+				ExpiresAt: item.ExpiresAt.String,
+				RevokedAt: item.RevokedAt.String,
+				CreatedAt: item.CreatedAt,
+				Invitees:  invitees,
+			},
+		)
+	}
+	WriteStructuredResponse(w, http.StatusOK, ListInvitesResponse{Results: resultsResponse})
+}
+
+func RevokeInviteHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	admin, err := IsAdmin(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	revoked, err := RevokeInvite(db, id, userId, admin)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if !revoked {
+		WriteGenericResponse(w, http.StatusNotFound, "Invite not found")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+func GetEditLinkDrawingHandler(db *sql.DB, link EditLinkRow, w http.ResponseWriter, r *http.Request) {
+	drawing, err := GetMutableDrawing(db, link.DrawingId, link.UserId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	if drawing.Name == "" {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	WriteStructuredResponse(w, http.StatusOK, GetEditLinkDrawingResponse{
+		Id:        drawing.Id,
+		Data:      drawing.Data,
+		Name:      drawing.Name,
+		CreatedAt: drawing.CreatedAt,
+		UpdatedAt: drawing.UpdatedAt,
+	})
 }
 
-func WriteStructuredResponse(w http.ResponseWriter, status int, data any) {
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+func UpdateEditLinkDrawingHandler(db *sql.DB, link EditLinkRow, w http.ResponseWriter, r *http.Request) {
+	ApplyMutableDrawingUpdate(db, link.DrawingId, link.UserId, link.Id, w, r)
 }
 
-func DecodeRequest(request any, w http.ResponseWriter, r *http.Request) bool {
-	err := json.NewDecoder(r.Body).Decode(&request)
-	if err == nil {
-		validate := validator.New()
-		err = validate.Struct(request)
-		if err == nil {
-			return true
+func ListMutableDrawingHistoryHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	results, err := ListMutableDrawingHistory(db, id, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	resultsResponse := []MutableDrawingHistoryResponse{}
+	for _, item := range results {
+		editor := "owner"
+		if item.EditLinkId.Valid {
+			editor = "link user"
 		}
+		resultsResponse = append(
+			resultsResponse,
+			MutableDrawingHistoryResponse{
+				EditedAt:   item.EditedAt,
+				Editor:     editor,
+				EditLinkId: int(item.EditLinkId.Int64),
+			},
+		)
 	}
-	WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
-	return false
+	WriteStructuredResponse(w, http.StatusOK, ListMutableDrawingHistoryResponse{Results: resultsResponse})
 }
 
-func (handler AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	sessionCookie, err := r.Cookie("sessionKey")
+func DeleteMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		WriteGenericResponse(w, http.StatusUnauthorized, "Unauthorized")
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
 		return
 	}
-	userId, err := GetSessionUserId(handler.Servicers.db, sessionCookie.Value)
+	deleted, err := DeleteMutableDrawing(db, id, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if userId > -1 {
-		handler.HandlerFunc(handler.Servicers.db, userId, w, r)
+	if !deleted {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
 		return
 	}
-	WriteGenericResponse(w, http.StatusUnauthorized, "Unauthorized")
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func (handler Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	handler.HandlerFunc(handler.Servicers.db, w, r)
+// attachmentWriter sends the headers of a file download on the first write,
+// so that an error response can still be sent until then.
+type attachmentWriter struct {
+	http.ResponseWriter
+	ContentType string
+	FileName    string
+	started     bool
 }
 
-func CreateUserHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	var request CreateUserRequest
-	if !DecodeRequest(&request, w, r) {
-		return
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.Header().Set("Content-Type", w.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, w.FileName))
+		w.WriteHeader(http.StatusOK)
 	}
-	if len(request.Password) < 5 {
-		WriteGenericResponse(w, http.StatusOK, "Password too short")
-		return
+	return w.ResponseWriter.Write(p)
+}
+
+func ExportMutableDrawingsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	includeText := r.URL.Query().Get("include_text") == "true"
+	attachment := &attachmentWriter{
+		ResponseWriter: w, ContentType: "application/zip", FileName: "cascii-drawings.zip",
 	}
-	parsedEmail, err := mail.ParseAddress(request.Email)
-	if err != nil || parsedEmail.Address != request.Email {
-		WriteGenericResponse(w, http.StatusOK, "Invalid email")
-		return
+	err := WriteMutableDrawingsExport(db, userId, ExportOptions{IncludeText: includeText}, attachment)
+	switch {
+	case err != nil && !attachment.started:
+		WriteUnknownError(w, err)
+	case err != nil:
+		// Too late for an error response, the client gets a truncated archive.
+		log.Print(err)
 	}
-	exists, err := UserExists(db, request.Email)
+}
+
+func ListTrashHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	results, err := ListTrashedMutableDrawings(db, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if exists {
-		WriteGenericResponse(w, http.StatusOK, "User already exists")
+	resultsResponse := []TrashedMutableDrawingResponse{}
+	for _, item := range results {
+		resultsResponse = append(resultsResponse, TrashedMutableDrawingResponse{
+			Id:        item.Id,
+			Name:      item.Name,
+			CreatedAt: item.CreatedAt,
+			DeletedAt: item.DeletedAt,
+			PurgeAt:   item.PurgeAt,
+		})
+	}
+	WriteStructuredResponse(w, http.StatusOK, ListTrashResponse{Results: resultsResponse})
+}
+
+func RestoreMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
 		return
 	}
-	if err := CreateUser(db, request.Email, request.Password); err != nil {
+	restored, err := RestoreMutableDrawing(db, id, userId)
+	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	WriteGenericResponse(w, http.StatusCreated, "")
+	if !restored {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func GetUserHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
-	email, err := GetUserById(db, userId)
+func PurgeMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	purged, err := PurgeMutableDrawing(db, id, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if email == "" {
-		WriteGenericResponse(w, http.StatusNotFound, "User not found")
+	if !purged {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
 		return
 	}
-	WriteStructuredResponse(w, http.StatusOK, UserResponse{Id: userId, Email: email})
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func AuthUserHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	var request AuthUserRequest
+func MoveMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var request MoveMutableDrawingRequest
 	if !DecodeRequest(&request, w, r) {
 		return
 	}
-	userId, err := Authenticate(db, request.Email, request.Password)
+	moved, err := MoveMutableDrawing(db, id, FolderIdOrNull(request.FolderId), userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if userId == -1 {
-		WriteGenericResponse(w, http.StatusOK, "User not found")
+	if !moved {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing or folder not found")
 		return
 	}
-	sessionKey, err := CreateSession(db, userId)
+	WriteGenericResponse(w, http.StatusOK, "")
+}
+
+// ParseListMutableDrawingsOptions reads the listing options from the query
+// string, e.g. ?sort=name&order=desc&name_prefix=pay&limit=20&cursor=...
+func ParseListMutableDrawingsOptions(r *http.Request) (ListMutableDrawingsOptions, bool) {
+	query := r.URL.Query()
+	options := ListMutableDrawingsOptions{
+		Sort:         query.Get("sort"),
+		NamePrefix:   query.Get("name_prefix"),
+		NameContains: query.Get("name_contains"),
+		Limit:        100,
+	}
+	if options.Sort == "" {
+		options.Sort = "created"
+	}
+	if _, ok := mutableDrawingSortColumns[options.Sort]; !ok {
+		return options, false
+	}
+	switch query.Get("order") {
+	case "asc":
+	case "desc":
+		options.Descending = true
+	case "":
+		// Newest first, but names alphabetically.
+		options.Descending = options.Sort != "name"
+	default:
+		return options, false
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > 100 {
+			return options, false
+		}
+		options.Limit = parsed
+	}
+	if folderId := query.Get("folder_id"); folderId != "" {
+		// 0 lists the drawings which aren't in any folder.
+		parsed, err := strconv.Atoi(folderId)
+		if err != nil || parsed < 0 {
+			return options, false
+		}
+		options.InFolder = true
+		options.FolderId = FolderIdOrNull(parsed)
+	}
+	if tags := query.Get("tags"); tags != "" {
+		// e.g. ?tags=payments,k8s&tag_match=all
+		options.Tags = NormaliseTags(strings.Split(tags, ","))
+		switch query.Get("tag_match") {
+		case "", "any":
+		case "all":
+			options.MatchAllTags = true
+		default:
+			return options, false
+		}
+	}
+	if encoded := query.Get("cursor"); encoded != "" {
+		cursor, err := DecodeMutableDrawingsCursor(encoded)
+		// A cursor only makes sense with the sort it came from.
+		if err != nil || cursor.Sort != options.Sort || cursor.Descending != options.Descending {
+			return options, false
+		}
+		options.Cursor = &cursor
+	}
+	return options, true
+}
+
+func ListMutableDrawingsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	options, ok := ParseListMutableDrawingsOptions(r)
+	if !ok {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	results, more, err := ListMutableDrawings(db, userId, options)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	cookie := &http.Cookie{
-		Name:     "sessionKey",
-		Value:    sessionKey,
-		HttpOnly: true,
-		Path:     "/",
-		Expires:  time.Now().Add(31536000 * time.Second), // 1 Year
-		Secure:   IsProd(),
-		SameSite: http.SameSiteStrictMode,
+	total, err := CountMutableDrawings(db, userId, options)
+	if err != nil {
+		WriteUnknownError(w, err)
+		return
 	}
-	http.SetCookie(w, cookie)
-	WriteGenericResponse(w, http.StatusAccepted, "")
+	var resultsResponse []MutableDrawingRowResponse
+	for _, item := range results {
+		resultsResponse = append(
+			resultsResponse,
+			MutableDrawingRowResponse{
+				Id:        item.Id,
+				Name:      item.Name,
+				CreatedAt: item.CreatedAt,
+				UpdatedAt: item.UpdatedAt,
+				FolderId:  int(item.FolderId.Int64),
+				Published: item.PublishToken.Valid,
+			},
+		)
+	}
+	nextCursor := ""
+	if more {
+		nextCursor = NewMutableDrawingsCursor(options, results[len(results)-1]).Encode()
+	}
+	WriteStructuredResponse(
+		w,
+		http.StatusOK,
+		ListMutableDrawingsResponse{Results: resultsResponse, NextCursor: nextCursor, Total: total},
+	)
 }
 
-func LogoutUserHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
-	if err := DeleteSession(db, userId); err != nil {
+func SearchMutableDrawingsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" || len(query) > 200 {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	// Publish tokens and edit links share a drawing with whoever holds the
+	// token, not with an account, so there are no drawings shared with the
+	// user to search besides their own.
+	results, err := SearchMutableDrawings(db, query, userId, 50)
+	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	cookie := &http.Cookie{
-		Name:     "sessionKey",
-		Value:    "",
-		HttpOnly: true,
-		Path:     "/",
-		Expires:  time.Unix(0, 0),
-		Secure:   IsProd(),
-		SameSite: http.SameSiteStrictMode,
+	resultsResponse := []SearchResultResponse{}
+	for _, item := range results {
+		resultsResponse = append(resultsResponse, SearchResultResponse{
+			Id:            item.Id,
+			Name:          item.Name,
+			CreatedAt:     item.CreatedAt,
+			Score:         item.Score,
+			NameHighlight: Highlight(item.Name, query),
+			TextHighlight: Highlight(item.TextContent, query),
+		})
 	}
-	http.SetCookie(w, cookie)
-	WriteGenericResponse(w, http.StatusOK, "")
+	WriteStructuredResponse(w, http.StatusOK, SearchMutableDrawingsResponse{Results: resultsResponse})
 }
 
-func CreateImmutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	var request CreateImmutableDrawingRequest
+func TagMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var request TagMutableDrawingRequest
 	if !DecodeRequest(&request, w, r) {
 		return
 	}
-	shortKey, err := CreateImmutableDrawing(db, request.Data)
+	tagged, err := AddMutableDrawingTags(db, id, request.Tags, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	WriteStructuredResponse(w, http.StatusOK, CreateImmutableDrawingResponse{ShortKey: shortKey})
+	if !tagged {
+		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func GetImmutableDrawingHandler(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	shortKey := mux.Vars(r)["short_key"]
-
-	// This is a side effect. if it fails, don't worry so much but log.
-	_, err := IncrementImmutableDrawingHits(db, shortKey)
+func UntagMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		log.Print(err)
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
 	}
-
-	data, hits, createdAt, err := GetImmutableDrawing(db, shortKey)
+	removed, err := RemoveMutableDrawingTag(db, id, mux.Vars(r)["tag"], userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if data == "" {
-		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+	if !removed {
+		WriteGenericResponse(w, http.StatusNotFound, "Tag not found")
 		return
 	}
-	response := GetImmutableDrawingResponse{Data: data, Hits: hits, CreatedAt: createdAt}
-	WriteStructuredResponse(w, http.StatusOK, response)
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func CreateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
-	var request CreateMutableDrawingRequest
-	if !DecodeRequest(&request, w, r) {
+func ListTagsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	results, err := ListTags(db, userId)
+	if err != nil {
+		WriteUnknownError(w, err)
 		return
 	}
+	resultsResponse := []TagResponse{}
+	for _, item := range results {
+		resultsResponse = append(resultsResponse, TagResponse{Name: item.Name, Count: item.Count})
+	}
+	WriteStructuredResponse(w, http.StatusOK, ListTagsResponse{Results: resultsResponse})
+}
 
+func CreateFolderHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	var request CreateFolderRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
 	if len(request.Name) > 100 {
 		WriteGenericResponse(w, http.StatusOK, "Name too long")
 		return
 	}
-
-	id, err := CreateMutableDrawing(db, request.Data, request.Name, userId)
+	if request.ParentId > 0 {
+		exists, err := FolderExists(db, request.ParentId, userId)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if !exists {
+			WriteGenericResponse(w, http.StatusNotFound, "Folder not found")
+			return
+		}
+	}
+	id, err := CreateFolder(db, request.Name, FolderIdOrNull(request.ParentId), userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	WriteStructuredResponse(w, http.StatusCreated, CreateMutableDrawingResponse{Id: id})
+	WriteStructuredResponse(w, http.StatusCreated, CreateFolderResponse{Id: id})
 }
 
-func GetMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(mux.Vars(r)["id"])
-	if err != nil {
-		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
-		return
-	}
-	name, data, createdAt, err := GetMutableDrawing(db, id, userId)
+func ListFoldersHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	results, err := ListFolders(db, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if name == "" {
-		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
-		return
+	resultsResponse := []FolderResponse{}
+	for _, item := range results {
+		resultsResponse = append(resultsResponse, FolderResponse{
+			Id:        item.Id,
+			ParentId:  int(item.ParentId.Int64),
+			Name:      item.Name,
+			CreatedAt: item.CreatedAt,
+		})
 	}
-	WriteStructuredResponse(w, http.StatusOK, GetMutableDrawingResponse{
-		Id: id, UserId: userId, Data: data, Name: name, CreatedAt: createdAt,
-	})
+	WriteStructuredResponse(w, http.StatusOK, ListFoldersResponse{Results: resultsResponse})
 }
 
-func UpdateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+func RenameFolderHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
 		return
 	}
-	var request UpdateMutableDrawingRequest
+	var request RenameFolderRequest
 	if !DecodeRequest(&request, w, r) {
 		return
 	}
@@ -325,52 +2456,72 @@ func UpdateMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter,
 		WriteGenericResponse(w, http.StatusOK, "Name too long")
 		return
 	}
-	updated, err := UpdateMutableDrawing(db, id, request.Data, request.Name, userId)
+	renamed, err := RenameFolder(db, id, request.Name, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if !updated {
+	if !renamed {
 		WriteGenericResponse(w, http.StatusNotAcceptable, "Nothing to update")
 		return
 	}
 	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func DeleteMutableDrawingHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+func MoveFolderHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
 		return
 	}
-	deleted, err := DeleteMutableDrawing(db, id, userId)
+	var request MoveFolderRequest
+	if !DecodeRequest(&request, w, r) {
+		return
+	}
+	moved, err := MoveFolder(db, id, FolderIdOrNull(request.ParentId), userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	if !deleted {
-		WriteGenericResponse(w, http.StatusNotFound, "Drawing not found")
+	if !moved {
+		WriteGenericResponse(w, http.StatusNotFound, "Folder not found")
 		return
 	}
 	WriteGenericResponse(w, http.StatusOK, "")
 }
 
-func ListMutableDrawingsHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
-	results, err := ListMutableDrawings(db, userId)
+func DeleteFolderHandler(db *sql.DB, userId int, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteGenericResponse(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	tree, err := GetFolderTree(db, id, userId)
 	if err != nil {
 		WriteUnknownError(w, err)
 		return
 	}
-	var resultsResponse []MutableDrawingRowResponse
-	for _, item := range results {
-		resultsResponse = append(
-			resultsResponse,
-			MutableDrawingRowResponse{Id: item.Id, Name: item.Name, CreatedAt: item.CreatedAt},
-		)
+	if len(tree) == 0 {
+		WriteGenericResponse(w, http.StatusNotFound, "Folder not found")
+		return
 	}
-	WriteStructuredResponse(
-		w, http.StatusOK, ListMutableDrawingsResponse{Results: resultsResponse},
-	)
+	// Deleting everything in a folder has to be asked for explicitly.
+	if r.URL.Query().Get("recursive") != "true" {
+		empty, err := IsFolderEmpty(db, tree)
+		if err != nil {
+			WriteUnknownError(w, err)
+			return
+		}
+		if !empty {
+			WriteGenericResponse(w, http.StatusConflict, "Folder not empty")
+			return
+		}
+	}
+	if err := DeleteFolderTree(db, tree, userId); err != nil {
+		WriteUnknownError(w, err)
+		return
+	}
+	WriteGenericResponse(w, http.StatusOK, "")
 }
 
 func AddApiRoutes(router *mux.Router, servicers *Servicers) {
@@ -378,14 +2529,69 @@ func AddApiRoutes(router *mux.Router, servicers *Servicers) {
 	userRouter.Handle("/", Handler{servicers, CreateUserHandler}).Methods("POST")
 	userRouter.Handle("/", AuthHandler{servicers, GetUserHandler}).Methods("GET")
 	userRouter.Handle("/auth", Handler{servicers, AuthUserHandler}).Methods("POST")
+	userRouter.Handle("/auth/mfa", Handler{servicers, MfaAuthHandler}).Methods("POST")
+	userRouter.Handle("/totp", AuthHandler{servicers, BeginTotpHandler}).Methods("POST")
+	userRouter.Handle("/totp/confirm", AuthHandler{servicers, ConfirmTotpHandler}).Methods("POST")
+	userRouter.Handle("/totp", AuthHandler{servicers, DisableTotpHandler}).Methods("DELETE")
+	userRouter.Handle("/oidc", Handler{servicers, ListOidcProvidersHandler}).Methods("GET")
+	userRouter.Handle("/oidc/{provider}/login", Handler{servicers, OidcLoginHandler}).Methods("GET")
+	userRouter.Handle("/oidc/{provider}/callback", Handler{servicers, OidcCallbackHandler}).Methods("GET")
+	userRouter.Handle("/login-link", Handler{servicers, RequestLoginLinkHandler}).Methods("POST")
+	userRouter.Handle("/login-link/redeem", Handler{servicers, RedeemLoginLinkHandler}).Methods("POST")
+	userRouter.Handle("/verify", Handler{servicers, VerifyEmailHandler}).Methods("GET")
+	userRouter.Handle("/verify/resend", Handler{servicers, ResendVerificationHandler}).Methods("POST")
+	userRouter.Handle("/", AuthHandler{servicers, DeleteUserHandler}).Methods("DELETE")
 	userRouter.Handle("/logout", AuthHandler{servicers, LogoutUserHandler}).Methods("GET")
+	userRouter.Handle("/password", AuthHandler{servicers, ChangePasswordHandler}).Methods("POST")
+	userRouter.Handle("/email", AuthHandler{servicers, ChangeEmailHandler}).Methods("POST")
+	userRouter.Handle("/email/verify", Handler{servicers, VerifyEmailChangeHandler}).Methods("GET")
+	userRouter.Handle("/invites", AuthHandler{servicers, CreateInviteHandler}).Methods("POST")
+	userRouter.Handle("/invites", AuthHandler{servicers, ListInvitesHandler}).Methods("GET")
+	userRouter.Handle("/invites/{id}", AuthHandler{servicers, RevokeInviteHandler}).Methods("DELETE")
+	userRouter.Handle("/data-export", AuthHandler{servicers, CreateDataExportHandler}).Methods("POST")
+	userRouter.Handle("/data-export/{id}", AuthHandler{servicers, GetDataExportHandler}).Methods("GET")
+	userRouter.Handle(
+		"/data-export/{id}/download", AuthHandler{servicers, DownloadDataExportHandler},
+	).Methods("GET")
 
 	drawingsRouter := router.PathPrefix("/api/drawings").Subrouter()
 	drawingsRouter.Handle("/immutable", Handler{servicers, CreateImmutableDrawingHandler}).Methods("POST")
 	drawingsRouter.Handle("/immutable/{short_key}", Handler{servicers, GetImmutableDrawingHandler}).Methods("GET")
+	drawingsRouter.Handle("/immutable/{short_key}/unlock", Handler{servicers, UnlockImmutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/immutable/{short_key}/fork", AuthHandler{servicers, ForkImmutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/slug", AuthHandler{servicers, ClaimSlugHandler}).Methods("POST")
+	drawingsRouter.Handle("/slug/{slug}", AuthHandler{servicers, UpdateSlugHandler}).Methods("PATCH")
+	drawingsRouter.Handle("/slug/{slug}", AuthHandler{servicers, GetSlugHandler}).Methods("GET")
 	drawingsRouter.Handle("/mutable", AuthHandler{servicers, CreateMutableDrawingHandler}).Methods("POST")
 	drawingsRouter.Handle("/mutable/{id}", AuthHandler{servicers, UpdateMutableDrawingHandler}).Methods("PATCH")
 	drawingsRouter.Handle("/mutable/{id}", AuthHandler{servicers, GetMutableDrawingHandler}).Methods("GET")
 	drawingsRouter.Handle("/mutable/{id}", AuthHandler{servicers, DeleteMutableDrawingHandler}).Methods("DELETE")
+	drawingsRouter.Handle("/mutable/{id}/duplicate", AuthHandler{servicers, DuplicateMutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/mutable/{id}/publish", AuthHandler{servicers, PublishMutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/mutable/{id}/publish", AuthHandler{servicers, UnpublishMutableDrawingHandler}).Methods("DELETE")
+	drawingsRouter.Handle("/published/{token}", Handler{servicers, GetPublishedMutableDrawingHandler}).Methods("GET")
+	drawingsRouter.Handle("/mutable/{id}/edit-links", AuthHandler{servicers, CreateEditLinkHandler}).Methods("POST")
+	drawingsRouter.Handle("/mutable/{id}/edit-links", AuthHandler{servicers, ListEditLinksHandler}).Methods("GET")
+	drawingsRouter.Handle("/mutable/{id}/edit-links/{link_id}", AuthHandler{servicers, RevokeEditLinkHandler}).Methods("DELETE")
+	drawingsRouter.Handle("/mutable/{id}/history", AuthHandler{servicers, ListMutableDrawingHistoryHandler}).Methods("GET")
+	drawingsRouter.Handle("/edit/{token}", EditLinkHandler{servicers, GetEditLinkDrawingHandler}).Methods("GET")
+	drawingsRouter.Handle("/edit/{token}", EditLinkHandler{servicers, UpdateEditLinkDrawingHandler}).Methods("PATCH")
+	drawingsRouter.Handle("/mutable/{id}/move", AuthHandler{servicers, MoveMutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/mutable/{id}/tags", AuthHandler{servicers, TagMutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/mutable/{id}/tags/{tag}", AuthHandler{servicers, UntagMutableDrawingHandler}).Methods("DELETE")
 	drawingsRouter.Handle("/mutables", AuthHandler{servicers, ListMutableDrawingsHandler}).Methods("GET")
+	drawingsRouter.Handle("/import", AuthHandler{servicers, ImportMutableDrawingsHandler}).Methods("POST")
+	drawingsRouter.Handle("/export", AuthHandler{servicers, ExportMutableDrawingsHandler}).Methods("GET")
+	drawingsRouter.Handle("/tags", AuthHandler{servicers, ListTagsHandler}).Methods("GET")
+	drawingsRouter.Handle("/search", AuthHandler{servicers, SearchMutableDrawingsHandler}).Methods("GET")
+	drawingsRouter.Handle("/trash", AuthHandler{servicers, ListTrashHandler}).Methods("GET")
+	drawingsRouter.Handle("/trash/{id}/restore", AuthHandler{servicers, RestoreMutableDrawingHandler}).Methods("POST")
+	drawingsRouter.Handle("/trash/{id}", AuthHandler{servicers, PurgeMutableDrawingHandler}).Methods("DELETE")
+
+	foldersRouter := router.PathPrefix("/api/folders").Subrouter()
+	foldersRouter.Handle("/", AuthHandler{servicers, CreateFolderHandler}).Methods("POST")
+	foldersRouter.Handle("/", AuthHandler{servicers, ListFoldersHandler}).Methods("GET")
+	foldersRouter.Handle("/{id}", AuthHandler{servicers, RenameFolderHandler}).Methods("PATCH")
+	foldersRouter.Handle("/{id}", AuthHandler{servicers, DeleteFolderHandler}).Methods("DELETE")
+	foldersRouter.Handle("/{id}/move", AuthHandler{servicers, MoveFolderHandler}).Methods("POST")
 }
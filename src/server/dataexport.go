@@ -0,0 +1,522 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DataExportDir is where finished personal data exports are kept until they
+// expire after DataExportRetentionDays.
+var DataExportDir = GetEnv("DATA_EXPORT_DIR", filepath.Join(os.TempDir(), "cascii-exports"))
+var DataExportRetentionDays = GetEnvInt("DATA_EXPORT_RETENTION_DAYS", 7)
+
+type DataExportRow struct {
+	Id          int
+	UserId      int
+	Status      string
+	FileName    sql.NullString
+	CreatedAt   string
+	CompletedAt sql.NullString
+	ExpiresAt   sql.NullString
+}
+
+// PersonalData is everything stored about a user, besides their drawings.
+type PersonalData struct {
+	User           PersonalDataUser            `json:"user"`
+	Sessions       []PersonalDataSession       `json:"sessions"`
+	Identities     []PersonalDataIdentity      `json:"identities"`
+	Slugs          []PersonalDataSlug          `json:"slugs"`
+	Folders        []ExportManifestFolder      `json:"folders"`
+	Tags           []string                    `json:"tags"`
+	Invites        []PersonalDataInvite        `json:"invites"`
+	EditLinks      []PersonalDataEditLink      `json:"edit_links"`
+	DrawingHistory []PersonalDataDrawingChange `json:"drawing_history"`
+	DataExports    []PersonalDataExport        `json:"data_exports"`
+}
+
+type PersonalDataUser struct {
+	Id           int    `json:"id"`
+	Email        string `json:"email"`
+	PendingEmail string `json:"pending_email,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	VerifiedAt   string `json:"verified_at,omitempty"`
+	DeleteAt     string `json:"delete_at,omitempty"`
+	TotpEnabled  bool   `json:"totp_enabled"`
+	// InviteId is the invite the user signed up with, issued by InvitedBy.
+	InviteId  int    `json:"invite_id,omitempty"`
+	InvitedBy string `json:"invited_by,omitempty"`
+}
+
+// PersonalDataSession identifies a session without giving away its key, and
+// says when it was logged into and when its key last changed.
+type PersonalDataSession struct {
+	Id              string `json:"id"`
+	AuthenticatedAt string `json:"authenticated_at"`
+	RotatedAt       string `json:"rotated_at"`
+}
+
+// PersonalDataIdentity is an identity provider account the user logs in with.
+type PersonalDataIdentity struct {
+	Provider    string `json:"provider"`
+	Subject     string `json:"subject"`
+	Email       string `json:"email,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	LastLoginAt string `json:"last_login_at,omitempty"`
+}
+
+type PersonalDataSlug struct {
+	Slug      string                    `json:"slug"`
+	ShortKey  string                    `json:"short_key"`
+	Hits      int                       `json:"hits"`
+	CreatedAt string                    `json:"created_at"`
+	UpdatedAt string                    `json:"updated_at"`
+	History   []PersonalDataSlugHistory `json:"history"`
+}
+
+type PersonalDataSlugHistory struct {
+	ShortKey   string `json:"short_key"`
+	ReplacedAt string `json:"replaced_at"`
+}
+
+// PersonalDataInvite is an invite the user issued, with who signed up with it.
+type PersonalDataInvite struct {
+	Id        int      `json:"id"`
+	MaxUses   int      `json:"max_uses,omitempty"`
+	Uses      int      `json:"uses"`
+	CreatedAt string   `json:"created_at"`
+	ExpiresAt string   `json:"expires_at,omitempty"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+	Invitees  []string `json:"invitees"`
+}
+
+type PersonalDataEditLink struct {
+	Id        int    `json:"id"`
+	DrawingId int    `json:"drawing_id"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+type PersonalDataDrawingChange struct {
+	DrawingId  int    `json:"drawing_id"`
+	EditedAt   string `json:"edited_at"`
+	EditLinkId int    `json:"edit_link_id,omitempty"`
+}
+
+type PersonalDataExport struct {
+	Id        int    `json:"id"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at"`
+}
+
+// CreateDataExport queues an export of the user's data, unless one is already
+// queued, returning its id either way.
+func CreateDataExport(db *sql.DB, userId int) (int, error) {
+	var id int
+	err := db.QueryRow(
+		"SELECT id FROM data_exports WHERE user_id = ? AND status IN ('pending', 'running')",
+		userId,
+	).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	res, err := db.Exec("INSERT INTO data_exports (user_id) VALUES (?)", userId)
+	if err != nil {
+		return -1, err
+	}
+	lastId, err := res.LastInsertId()
+	return int(lastId), err
+}
+
+func GetDataExport(db *sql.DB, exportId int, userId int) (DataExportRow, error) {
+	var row DataExportRow
+	err := db.QueryRow(
+		`SELECT id, user_id, status, file_name, created_at, completed_at, expires_at
+		FROM data_exports WHERE id = ? AND user_id = ?`,
+		exportId,
+		userId,
+	).Scan(
+		&row.Id, &row.UserId, &row.Status, &row.FileName,
+		&row.CreatedAt, &row.CompletedAt, &row.ExpiresAt,
+	)
+	if err == nil || err == sql.ErrNoRows {
+		return row, nil
+	}
+	return row, err
+}
+
+// ClaimDataExport marks the oldest queued export as running and returns it,
+// or a row with Id 0 if there is none. Exports still running an hour after
+// they were claimed, say because of a restart, are picked up again.
+func ClaimDataExport(db *sql.DB) (DataExportRow, error) {
+	var row DataExportRow
+	tx, err := db.Begin()
+	if err != nil {
+		return row, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`SELECT id, user_id, status, created_at FROM data_exports
+		WHERE status = 'pending'
+		OR (status = 'running' AND started_at < UTC_TIMESTAMP() - INTERVAL 1 HOUR)
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED`,
+	).Scan(&row.Id, &row.UserId, &row.Status, &row.CreatedAt)
+	if err == sql.ErrNoRows {
+		return row, nil
+	}
+	if err != nil {
+		return row, err
+	}
+	_, err = tx.Exec(
+		"UPDATE data_exports SET status = 'running', started_at = UTC_TIMESTAMP() WHERE id = ?", row.Id,
+	)
+	if err != nil {
+		return row, err
+	}
+	row.Status = "running"
+	return row, tx.Commit()
+}
+
+func CompleteDataExport(db *sql.DB, exportId int, fileName string) error {
+	_, err := db.Exec(
+		`UPDATE data_exports SET status = 'ready', file_name = ?, completed_at = UTC_TIMESTAMP(),
+		expires_at = UTC_TIMESTAMP() + INTERVAL ? DAY WHERE id = ?`,
+		fileName,
+		DataExportRetentionDays,
+		exportId,
+	)
+	return err
+}
+
+func FailDataExport(db *sql.DB, exportId int) error {
+	_, err := db.Exec(
+		"UPDATE data_exports SET status = 'failed', completed_at = UTC_TIMESTAMP() WHERE id = ?",
+		exportId,
+	)
+	return err
+}
+
+// GetPersonalData gathers everything stored about the user, besides their
+// drawings.
+func GetPersonalData(db *sql.DB, userId int) (PersonalData, error) {
+	data := PersonalData{
+		Sessions:       []PersonalDataSession{},
+		Identities:     []PersonalDataIdentity{},
+		Slugs:          []PersonalDataSlug{},
+		Folders:        []ExportManifestFolder{},
+		Tags:           []string{},
+		Invites:        []PersonalDataInvite{},
+		EditLinks:      []PersonalDataEditLink{},
+		DrawingHistory: []PersonalDataDrawingChange{},
+		DataExports:    []PersonalDataExport{},
+	}
+	var pendingEmail, verifiedAt, deleteAt, invitedBy sql.NullString
+	var inviteId sql.NullInt64
+	err := db.QueryRow(
+		`SELECT u.id, u.email, u.pending_email, IFNULL(u.created_at, ''), u.verified_at, u.delete_at,
+		u.totp_enabled_at IS NOT NULL, u.invite_id, inviter.email
+		FROM users u
+		LEFT JOIN invites i ON i.id = u.invite_id
+		LEFT JOIN users inviter ON inviter.id = i.user_id
+		WHERE u.id = ?`,
+		userId,
+	).Scan(
+		&data.User.Id, &data.User.Email, &pendingEmail, &data.User.CreatedAt, &verifiedAt, &deleteAt,
+		&data.User.TotpEnabled, &inviteId, &invitedBy,
+	)
+	if err != nil {
+		return data, err
+	}
+	data.User.PendingEmail = pendingEmail.String
+	data.User.VerifiedAt = verifiedAt.String
+	data.User.DeleteAt = deleteAt.String
+	data.User.InviteId = int(inviteId.Int64)
+	data.User.InvitedBy = invitedBy.String
+
+	// Each section is read with a query and a function to scan its rows.
+	sections := []struct {
+		query string
+		scan  func(rows *sql.Rows) error
+	}{
+		{
+			`SELECT key_hash, authenticated_at, rotated_at FROM sessions
+			WHERE user_id = ? ORDER BY authenticated_at`,
+			func(rows *sql.Rows) error {
+				var session PersonalDataSession
+				var keyHash string
+				if err := rows.Scan(&keyHash, &session.AuthenticatedAt, &session.RotatedAt); err != nil {
+					return err
+				}
+				session.Id = keyHash[:16]
+				data.Sessions = append(data.Sessions, session)
+				return nil
+			},
+		},
+		{
+			`SELECT provider, subject, IFNULL(email, ''), created_at, IFNULL(last_login_at, '')
+			FROM user_identities WHERE user_id = ? ORDER BY id`,
+			func(rows *sql.Rows) error {
+				var identity PersonalDataIdentity
+				err := rows.Scan(
+					&identity.Provider, &identity.Subject, &identity.Email,
+					&identity.CreatedAt, &identity.LastLoginAt,
+				)
+				data.Identities = append(data.Identities, identity)
+				return err
+			},
+		},
+		{
+			`SELECT slugs.slug, slugs.short_key, IFNULL(immutable_drawings.hits, 0),
+			slugs.created_at, slugs.updated_at FROM slugs
+			LEFT JOIN immutable_drawings ON immutable_drawings.short_key = slugs.short_key
+			WHERE slugs.user_id = ? ORDER BY slugs.slug`,
+			func(rows *sql.Rows) error {
+				slug := PersonalDataSlug{History: []PersonalDataSlugHistory{}}
+				err := rows.Scan(&slug.Slug, &slug.ShortKey, &slug.Hits, &slug.CreatedAt, &slug.UpdatedAt)
+				data.Slugs = append(data.Slugs, slug)
+				return err
+			},
+		},
+		{
+			"SELECT name FROM tags WHERE user_id = ? ORDER BY name",
+			func(rows *sql.Rows) error {
+				var tag string
+				err := rows.Scan(&tag)
+				data.Tags = append(data.Tags, tag)
+				return err
+			},
+		},
+		{
+			`SELECT l.id, l.drawing_id, l.created_at, IFNULL(l.expires_at, ''), IFNULL(l.revoked_at, '')
+			FROM edit_links l JOIN mutable_drawings d ON d.id = l.drawing_id
+			WHERE d.user_id = ? ORDER BY l.id`,
+			func(rows *sql.Rows) error {
+				var link PersonalDataEditLink
+				err := rows.Scan(&link.Id, &link.DrawingId, &link.CreatedAt, &link.ExpiresAt, &link.RevokedAt)
+				data.EditLinks = append(data.EditLinks, link)
+				return err
+			},
+		},
+		{
+			`SELECT h.drawing_id, h.edited_at, IFNULL(h.edit_link_id, 0)
+			FROM mutable_drawing_history h JOIN mutable_drawings d ON d.id = h.drawing_id
+			WHERE d.user_id = ? ORDER BY h.id`,
+			func(rows *sql.Rows) error {
+				var change PersonalDataDrawingChange
+				err := rows.Scan(&change.DrawingId, &change.EditedAt, &change.EditLinkId)
+				data.DrawingHistory = append(data.DrawingHistory, change)
+				return err
+			},
+		},
+		{
+			"SELECT id, status, created_at FROM data_exports WHERE user_id = ? ORDER BY id",
+			func(rows *sql.Rows) error {
+				var export PersonalDataExport
+				err := rows.Scan(&export.Id, &export.Status, &export.CreatedAt)
+				data.DataExports = append(data.DataExports, export)
+				return err
+			},
+		},
+	}
+	for _, section := range sections {
+		rows, err := db.Query(section.query, userId)
+		if err != nil {
+			return data, err
+		}
+		for rows.Next() {
+			if err := section.scan(rows); err != nil {
+				rows.Close()
+				return data, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return data, err
+		}
+	}
+
+	for i, slug := range data.Slugs {
+		history, err := ListSlugHistory(db, slug.Slug)
+		if err != nil {
+			return data, err
+		}
+		for _, item := range history {
+			data.Slugs[i].History = append(
+				data.Slugs[i].History,
+				PersonalDataSlugHistory{ShortKey: item.ShortKey, ReplacedAt: item.ReplacedAt},
+			)
+		}
+	}
+	invites, err := ListInvites(db, userId, false)
+	if err != nil {
+		return data, err
+	}
+	for _, invite := range invites {
+		invitees := invite.Invitees
+		if invitees == nil {
+			invitees = []string{}
+		}
+		data.Invites = append(data.Invites, PersonalDataInvite{
+			Id:        invite.Id,
+			MaxUses:   int(invite.MaxUses.Int64),
+			Uses:      invite.Uses,
+			CreatedAt: invite.CreatedAt,
+			ExpiresAt: invite.ExpiresAt.String,
+			RevokedAt: invite.RevokedAt.String,
+			Invitees:  invitees,
+		})
+	}
+	folders, err := ListFolders(db, userId)
+	if err != nil {
+		return data, err
+	}
+	paths := folderPaths(folders)
+	for _, folder := range folders {
+		data.Folders = append(data.Folders, ExportManifestFolder{
+			Id:       folder.Id,
+			ParentId: int(folder.ParentId.Int64),
+			Name:     folder.Name,
+			Path:     paths[folder.Id],
+		})
+	}
+	return data, nil
+}
+
+// WritePersonalDataExport writes a zip of everything stored about the user to
+// w: their data in data.json, and their drawings, trash included, in the same
+// layout as a drawings export.
+func WritePersonalDataExport(db *sql.DB, userId int, w io.Writer) error {
+	data, err := GetPersonalData(db, userId)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+	if err := AddMutableDrawingsToArchive(
+		db, userId, ExportOptions{IncludeTrashed: true}, archive,
+	); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// RunDataExport writes the export's archive into DataExportDir, returning the
+// file's name.
+func RunDataExport(db *sql.DB, export DataExportRow) (string, error) {
+	if err := os.MkdirAll(DataExportDir, 0o700); err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("%d-%s.zip", export.Id, RandomBase62(16))
+	file, err := os.Create(filepath.Join(DataExportDir, fileName))
+	if err != nil {
+		return "", err
+	}
+	if err := WritePersonalDataExport(db, export.UserId, file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	// The archive may not all be written until it's closed.
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return fileName, nil
+}
+
+// RunDataExports runs every queued export, and lets its user know when it's
+// ready. It returns how many it ran.
+func RunDataExports(db *sql.DB) (int, error) {
+	ran := 0
+	for {
+		export, err := ClaimDataExport(db)
+		if err != nil || export.Id == 0 {
+			return ran, err
+		}
+		fileName, err := RunDataExport(db, export)
+		if err != nil {
+			if failErr := FailDataExport(db, export.Id); failErr != nil {
+				return ran, failErr
+			}
+			return ran, err
+		}
+		if err := CompleteDataExport(db, export.Id, fileName); err != nil {
+			return ran, err
+		}
+		ran++
+
+		email, err := GetUserById(db, export.UserId)
+		if err != nil {
+			return ran, err
+		}
+		if err := DefaultMailer.Send(Mail{
+			To:      email,
+			Subject: "Your cascii data export is ready",
+			Body: fmt.Sprintf(
+				"Download it within %d days, while logged in, from:\n\n%s/api/user/data-export/%d/download",
+				DataExportRetentionDays, BaseUrl, export.Id,
+			),
+		}); err != nil {
+			return ran, err
+		}
+	}
+}
+
+// PurgeExpiredDataExports deletes exports, and their files, once they expire.
+// It returns how many were deleted.
+func PurgeExpiredDataExports(db *sql.DB) (int, error) {
+	rows, err := db.Query(
+		"SELECT id, file_name FROM data_exports WHERE expires_at <= UTC_TIMESTAMP()",
+	)
+	if err != nil {
+		return 0, err
+	}
+	files := map[int]sql.NullString{}
+	for rows.Next() {
+		var id int
+		var fileName sql.NullString
+		if err := rows.Scan(&id, &fileName); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files[id] = fileName
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, fileName := range files {
+		if err := RemoveDataExportFile(fileName); err != nil {
+			return 0, err
+		}
+		if _, err := db.Exec("DELETE FROM data_exports WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
+
+func RemoveDataExportFile(fileName sql.NullString) error {
+	if !fileName.Valid {
+		return nil
+	}
+	err := os.Remove(filepath.Join(DataExportDir, fileName.String))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	// Docs: http://go-database-sql.org/accessing.html
 	"database/sql"
@@ -41,3 +42,8 @@ func (dbFactory DbFactory) GetConnectionString() string {
 		os.Getenv("DB_NAME"),
 	)
 }
+
+// SqlPlaceholders makes the placeholders for an IN clause of count values.
+func SqlPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
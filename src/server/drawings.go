@@ -2,69 +2,255 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/VividCortex/mysqlerr"
 	"github.com/go-sql-driver/mysql"
 )
 
-type MutableDrawingRow struct {
-	Id        int
-	Name      string
+type ImmutableDrawingRow struct {
+	// Data is the ciphertext if the drawing is encrypted, i.e. has an Algorithm.
+	Data      string
+	Algorithm sql.NullString
+	Hits      int
 	CreatedAt string
+	ExpiresAt sql.NullString
+	MaxViews  sql.NullInt64
+	Password  sql.NullString
+	// Gone is set once the drawing has expired or used up its views, until the
+	// sweeper gets around to deleting it.
+	Gone bool
+}
+
+type ImmutableDrawingOptions struct {
+	ExpiresAt *time.Time
+	MaxViews  int
+	Password  string
+	// If Algorithm is set, the drawing data is an opaque ciphertext which the
+	// client encrypted with a key the server never sees.
+	Algorithm string
+}
+
+func (options ImmutableDrawingOptions) IsRestricted() bool {
+	return options.ExpiresAt != nil || options.MaxViews > 0 || options.Password != ""
+}
+
+const immutableDrawingAccessTTL = time.Hour
+
+// MakeImmutableDrawingAccessToken grants access to a password protected
+// drawing, for that short key only, until the token expires.
+func MakeImmutableDrawingAccessToken(shortKey string, expires time.Time) string {
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	return expiresUnix + "." + Sign(shortKey+"."+expiresUnix)
+}
+
+func CheckImmutableDrawingAccessToken(shortKey string, token string) bool {
+	expiresUnix, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresUnix, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return VerifySignature(shortKey+"."+expiresUnix, signature)
+}
+
+type MutableDrawingRow struct {
+	Id                 int
+	Name               string
+	Data               string
+	CreatedAt          string
+	UpdatedAt          string
+	FolderId           sql.NullInt64
+	ForkedFromId       sql.NullInt64
+	ForkedFromShortKey sql.NullString
+	PublishToken       sql.NullString
+}
+
+var mutableDrawingSortColumns = map[string]string{
+	"created": "created_at",
+	"updated": "updated_at",
+	"name":    "name",
+}
+
+type ListMutableDrawingsOptions struct {
+	// Sort is one of "created", "updated" or "name".
+	Sort         string
+	Descending   bool
+	NamePrefix   string
+	NameContains string
+	// If InFolder is set, only drawings directly in FolderId are listed, where
+	// a null FolderId means those not in any folder.
+	InFolder bool
+	FolderId sql.NullInt64
+	// Tags filters to drawings with any of the tags, or all of them if
+	// MatchAllTags is set.
+	Tags         []string
+	MatchAllTags bool
+	// Cursor is where the previous page left off, if any.
+	Cursor *MutableDrawingsCursor
+	Limit  int
+}
+
+// MutableDrawingsCursor is the position of the last drawing on a page, in
+// terms of the sort it was listed with.
+type MutableDrawingsCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Value      string `json:"v"`
+	Id         int    `json:"id"`
+}
+
+func NewMutableDrawingsCursor(options ListMutableDrawingsOptions, row MutableDrawingRow) MutableDrawingsCursor {
+	value := map[string]string{
+		"created": row.CreatedAt,
+		"updated": row.UpdatedAt,
+		"name":    row.Name,
+	}[options.Sort]
+	return MutableDrawingsCursor{
+		Sort: options.Sort, Descending: options.Descending, Value: value, Id: row.Id,
+	}
+}
+
+func (cursor MutableDrawingsCursor) Encode() string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func DecodeMutableDrawingsCursor(encoded string) (MutableDrawingsCursor, error) {
+	var cursor MutableDrawingsCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(decoded, &cursor)
+	return cursor, err
+}
+
+func EscapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
 }
 
-func CreateImmutableDrawing(db *sql.DB, data string) (string, error) {
+func CreateImmutableDrawing(db *sql.DB, data string, options ImmutableDrawingOptions) (string, error) {
 	hash := Hash(data)
-	var err error
-	for i := 5; i < 10; i++ {
-		shortKey := hash[:i]
-		_, err := db.Exec(
-			"INSERT INTO immutable_drawings (short_key, hash, data) VALUES (?, ?, ?)",
+	keyHash := hash
+	if options.IsRestricted() {
+		// Restricted drawings must never be shared with an identical drawing
+		// (e.g. burning one after reading would burn the other), so their short
+		// key is derived from a random hash instead.
+		keyHash = Hash(hash + GenerateUUID())
+	}
+	expiresAt := sql.NullTime{}
+	if options.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: options.ExpiresAt.UTC(), Valid: true}
+	}
+	maxViews := sql.NullInt64{Int64: int64(options.MaxViews), Valid: options.MaxViews > 0}
+	plaintext := sql.NullString{String: data, Valid: options.Algorithm == ""}
+	ciphertext := sql.NullString{String: data, Valid: options.Algorithm != ""}
+	algorithm := sql.NullString{String: options.Algorithm, Valid: options.Algorithm != ""}
+	password := sql.NullString{}
+	if options.Password != "" {
+		passwordHash, err := HashPassword(options.Password)
+		if err != nil {
+			return "", err
+		}
+		password = sql.NullString{String: passwordHash, Valid: true}
+	}
+
+	if !options.IsRestricted() {
+		// Identical drawings share a short key. This also keeps using the hex
+		// short keys of drawings shared before keys were base62.
+		shortKey, err := GetSharedImmutableDrawingShortKey(db, hash, options.Algorithm)
+		if err != nil || shortKey != "" {
+			return shortKey, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		shortKey := ShortKeyGenerator.Key(keyHash, attempt)
+		// Short keys take precedence over slugs, so one mustn't take over a
+		// slug someone has already claimed.
+		slugShortKey, err := GetSlugShortKey(db, shortKey)
+		if err != nil {
+			return "", err
+		}
+		if slugShortKey != "" {
+			continue
+		}
+		_, err = db.Exec(
+			`INSERT INTO immutable_drawings
+			(short_key, hash, data, ciphertext, algorithm, expires_at, max_views, password)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 			shortKey,
 			hash,
-			data,
+			plaintext,
+			ciphertext,
+			algorithm,
+			expiresAt,
+			maxViews,
+			password,
 		)
 		if err == nil {
 			return shortKey, nil
 		}
-		if driverErr, ok := err.(*mysql.MySQLError); ok {
-			if driverErr.Number == mysqlerr.ER_DUP_ENTRY {
-				// Our short key is already used, we try and resolve this...
-				var existingHash string
-				err = db.QueryRow(
-					"SELECT hash FROM immutable_drawings WHERE short_key = ?", shortKey,
-				).Scan(&existingHash)
-				// The existing drawing is the same as the requested one, so we can
-				// just use that one.
-				if hash == existingHash {
-					return shortKey, nil
-				}
-				// The drawings are different - the conflict is just bad luck!
-				// We try again with a longer short key.
-				continue
-			}
+		if driverErr, ok := err.(*mysql.MySQLError); !ok || driverErr.Number != mysqlerr.ER_DUP_ENTRY {
+			// The error is unrelated to duplicates, so we can't fix it.
+			return "", err
 		}
-		// The error is unrelated to duplicates, so we can't fix it.
-		return "", err
+		// Our short key is already used by a different drawing - the conflict
+		// is just bad luck! We try again with the next key.
 	}
-	// Surely impossible, but there was no conflict resolution after 10 characters.
-	return "", err
 }
 
-func GetImmutableDrawing(db *sql.DB, shortKey string) (string, int, string, error) {
-	var data string
-	var hits int
-	var createdAt string
-	err := db.QueryRow("SELECT data, hits, created_at FROM immutable_drawings WHERE short_key = ?", shortKey).Scan(&data, &hits, &createdAt)
+// GetSharedImmutableDrawingShortKey finds an unrestricted drawing with the
+// given hash (of its data, or ciphertext for the algorithm), if there is one.
+func GetSharedImmutableDrawingShortKey(db *sql.DB, hash string, algorithm string) (string, error) {
+	var shortKey string
+	err := db.QueryRow(
+		`SELECT short_key FROM immutable_drawings
+		WHERE hash = ? AND IFNULL(algorithm, '') = ?
+		AND expires_at IS NULL AND max_views IS NULL AND password IS NULL
+		ORDER BY id LIMIT 1`,
+		hash,
+		algorithm,
+	).Scan(&shortKey)
 	if err == nil || err == sql.ErrNoRows {
-		return data, hits, createdAt, nil
+		return shortKey, nil
 	}
-	return data, hits, createdAt, err
+	return shortKey, err
 }
 
+func GetImmutableDrawing(db *sql.DB, shortKey string) (ImmutableDrawingRow, error) {
+	var row ImmutableDrawingRow
+	err := db.QueryRow(
+		`SELECT COALESCE(data, ciphertext), algorithm, hits, created_at,
+		expires_at, max_views, password,
+		(expires_at IS NOT NULL AND expires_at <= UTC_TIMESTAMP())
+		OR (max_views IS NOT NULL AND hits > max_views)
+		FROM immutable_drawings WHERE short_key = ?`, shortKey,
+	).Scan(
+		&row.Data, &row.Algorithm, &row.Hits, &row.CreatedAt,
+		&row.ExpiresAt, &row.MaxViews, &row.Password, &row.Gone,
+	)
+	if err == nil || err == sql.ErrNoRows {
+		return row, nil
+	}
+	return row, err
+}
+
+// IncrementImmutableDrawingHits counts a view of the drawing, returning false
+// if it doesn't exist or has expired or used up its views.
 func IncrementImmutableDrawingHits(db *sql.DB, shortKey string) (bool, error) {
 	res, err := db.Exec(
-		"UPDATE immutable_drawings SET hits = hits + 1 WHERE short_key = ?", shortKey,
+		`UPDATE immutable_drawings SET hits = hits + 1 WHERE short_key = ?
+		AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())
+		AND (max_views IS NULL OR hits <= max_views)`, shortKey,
 	)
 	if err != nil {
 		return false, err
@@ -76,12 +262,71 @@ func IncrementImmutableDrawingHits(db *sql.DB, shortKey string) (bool, error) {
 	return affected == 1, nil
 }
 
+// After MaxImmutableDrawingPasswordFailures wrong passwords in a row, a
+// drawing's password isn't checked until immutableDrawingPasswordLockout has
+// passed since the last one, as with TOTP codes.
+const (
+	MaxImmutableDrawingPasswordFailures = 5
+	immutableDrawingPasswordLockout     = 15 * time.Minute
+)
+
+// CheckImmutableDrawingPassword reports whether the password is the drawing's,
+// and whether it's locked after too many wrong ones.
+func CheckImmutableDrawingPassword(db *sql.DB, shortKey string, password string) (bool, bool, error) {
+	var hash sql.NullString
+	var locked bool
+	err := db.QueryRow(
+		`SELECT password, password_failures >= ?
+		AND password_failed_at > UTC_TIMESTAMP() - INTERVAL ? SECOND
+		FROM immutable_drawings WHERE short_key = ?`,
+		MaxImmutableDrawingPasswordFailures,
+		int(immutableDrawingPasswordLockout.Seconds()),
+		shortKey,
+	).Scan(&hash, &locked)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil || locked || !hash.Valid {
+		return false, locked, err
+	}
+	if CheckPassword(hash.String, password) {
+		_, err := db.Exec(
+			"UPDATE immutable_drawings SET password_failures = 0 WHERE short_key = ?", shortKey,
+		)
+		return err == nil, false, err
+	}
+	// A failure after the lockout has passed starts the count again.
+	_, err = db.Exec(
+		`UPDATE immutable_drawings SET password_failed_at = UTC_TIMESTAMP(),
+		password_failures = IF(password_failures >= ?, 1, password_failures + 1)
+		WHERE short_key = ?`,
+		MaxImmutableDrawingPasswordFailures,
+		shortKey,
+	)
+	return false, false, err
+}
+
+func PurgeGoneImmutableDrawings(db *sql.DB) (int64, error) {
+	res, err := db.Exec(
+		`DELETE FROM immutable_drawings
+		WHERE (expires_at IS NOT NULL AND expires_at <= UTC_TIMESTAMP())
+		OR (max_views IS NOT NULL AND hits > max_views)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func CreateMutableDrawing(db *sql.DB, data string, name string, userId int) (int, error) {
 	res, err := db.Exec(
-		"INSERT INTO mutable_drawings (user_id, name, data) VALUES (?, ?, ?)",
+		`INSERT INTO mutable_drawings (user_id, name, data, text_content, data_hash)
+		VALUES (?, ?, ?, ?, ?)`,
 		userId,
 		name,
 		data,
+		ExtractDrawingText(data),
+		DrawingHash(data),
 	)
 	if err != nil {
 		return -1, err
@@ -93,13 +338,29 @@ func CreateMutableDrawing(db *sql.DB, data string, name string, userId int) (int
 	return int(id), err
 }
 
-func UpdateMutableDrawing(db *sql.DB, drawingId int, data string, name string, userId int) (bool, error) {
-	res, err := db.Exec(
+// UpdateMutableDrawing updates the drawing and records the edit in its
+// history, attributed to the edit link if one (non zero) was used.
+func UpdateMutableDrawing(
+	db *sql.DB, drawingId int, data string, name string, userId int, editLinkId int,
+) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
 		`UPDATE mutable_drawings SET
 		data = COALESCE(NULLIF(?, ''), data),
+		text_content = IF(? = '', text_content, ?),
+		data_hash = IF(? = '', data_hash, ?),
 		name = COALESCE(NULLIF(?, ''), name)
-		WHERE id = ? AND user_id = ?`,
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		data,
+		data,
+		ExtractDrawingText(data),
 		data,
+		DrawingHash(data),
 		name,
 		drawingId,
 		userId,
@@ -108,28 +369,114 @@ func UpdateMutableDrawing(db *sql.DB, drawingId int, data string, name string, u
 		return false, err
 	}
 	affected, err := res.RowsAffected()
-	if err != nil {
+	if err != nil || affected == 0 {
 		return false, err
 	}
-	return affected == 1, nil
+	if _, err = tx.Exec(
+		"INSERT INTO mutable_drawing_history (drawing_id, edit_link_id) VALUES (?, ?)",
+		drawingId,
+		sql.NullInt64{Int64: int64(editLinkId), Valid: editLinkId > 0},
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-func GetMutableDrawing(db *sql.DB, drawingId int, userId int) (string, string, string, error) {
-	var data string
-	var createdAt string
-	var name string
+func GetMutableDrawing(db *sql.DB, drawingId int, userId int) (MutableDrawingRow, error) {
+	row := MutableDrawingRow{Id: drawingId}
 	err := db.QueryRow(
-		"SELECT name, data, created_at FROM mutable_drawings WHERE id = ? AND user_id = ?", drawingId, userId,
-	).Scan(&name, &data, &createdAt)
+		`SELECT name, data, created_at, updated_at, folder_id,
+		forked_from_id, forked_from_short_key, publish_token
+		FROM mutable_drawings WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		drawingId,
+		userId,
+	).Scan(
+		&row.Name, &row.Data, &row.CreatedAt, &row.UpdatedAt, &row.FolderId,
+		&row.ForkedFromId, &row.ForkedFromShortKey, &row.PublishToken,
+	)
 	if err == nil || err == sql.ErrNoRows {
-		return name, data, createdAt, nil
+		return row, nil
+	}
+	return row, err
+}
+
+// DuplicateMutableDrawing copies the user's drawing, along with its tags, into
+// a new one. It returns -1 if there is no such drawing.
+func DuplicateMutableDrawing(db *sql.DB, drawingId int, userId int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
 	}
-	return name, data, createdAt, err
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO mutable_drawings
+		(user_id, name, data, text_content, data_hash, folder_id, forked_from_id)
+		SELECT user_id, LEFT(CONCAT(name, ' (copy)'), 100), data, text_content, data_hash, folder_id, id
+		FROM mutable_drawings WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return -1, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	if _, err = tx.Exec(
+		`INSERT INTO mutable_drawing_tags (drawing_id, tag_id)
+		SELECT ?, tag_id FROM mutable_drawing_tags WHERE drawing_id = ?`,
+		id,
+		drawingId,
+	); err != nil {
+		return -1, err
+	}
+	return int(id), tx.Commit()
 }
 
+// ForkImmutableDrawing copies a short linked drawing into a new drawing of the
+// user's, named after the key (short key or slug) it was opened with. It
+// returns -1 if the drawing is missing, encrypted or gone by now.
+func ForkImmutableDrawing(db *sql.DB, shortKey string, name string, data string, userId int) (int, error) {
+	// The data itself is copied within the database, it is only needed here
+	// to derive the text and hash from.
+	res, err := db.Exec(
+		`INSERT INTO mutable_drawings
+		(user_id, name, data, text_content, data_hash, forked_from_short_key)
+		SELECT ?, ?, data, ?, ?, short_key FROM immutable_drawings
+		WHERE short_key = ? AND data IS NOT NULL
+		AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())
+		AND (max_views IS NULL OR hits <= max_views)`,
+		userId,
+		name,
+		ExtractDrawingText(data),
+		DrawingHash(data),
+		shortKey,
+	)
+	if err != nil {
+		return -1, err
+	}
+	forked, err := res.RowsAffected()
+	if err != nil || forked == 0 {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+// DeleteMutableDrawing moves the drawing to the trash, from where it can be
+// restored until it is purged.
 func DeleteMutableDrawing(db *sql.DB, drawingId int, userId int) (bool, error) {
 	res, err := db.Exec(
-		"DELETE FROM mutable_drawings WHERE id = ? AND user_id = ?",
+		`UPDATE mutable_drawings SET deleted_at = UTC_TIMESTAMP(), updated_at = updated_at
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
 		drawingId,
 		userId,
 	)
@@ -143,27 +490,98 @@ func DeleteMutableDrawing(db *sql.DB, drawingId int, userId int) (bool, error) {
 	return deleted == 1, nil
 }
 
-func ListMutableDrawings(db *sql.DB, userId int) ([]MutableDrawingRow, error) {
+// mutableDrawingsFilter builds the WHERE clause for listing a user's
+// drawings, not including the cursor.
+func mutableDrawingsFilter(userId int, options ListMutableDrawingsOptions) (string, []any) {
+	where := "user_id = ? AND deleted_at IS NULL"
+	args := []any{userId}
+	if options.NamePrefix != "" {
+		where += " AND name LIKE ?"
+		args = append(args, EscapeLike(options.NamePrefix)+"%")
+	}
+	if options.NameContains != "" {
+		where += " AND name LIKE ?"
+		args = append(args, "%"+EscapeLike(options.NameContains)+"%")
+	}
+	if options.InFolder {
+		where += " AND folder_id <=> ?"
+		args = append(args, options.FolderId)
+	}
+	if len(options.Tags) > 0 {
+		tagged := `SELECT mutable_drawing_tags.drawing_id FROM mutable_drawing_tags
+			JOIN tags ON tags.id = mutable_drawing_tags.tag_id
+			WHERE tags.user_id = ? AND tags.name IN (` + SqlPlaceholders(len(options.Tags)) + `)`
+		args = append(args, userId)
+		for _, tag := range options.Tags {
+			args = append(args, tag)
+		}
+		if options.MatchAllTags {
+			tagged += " GROUP BY mutable_drawing_tags.drawing_id HAVING COUNT(*) = ?"
+			args = append(args, len(options.Tags))
+		}
+		where += " AND id IN (" + tagged + ")"
+	}
+	return where, args
+}
+
+// ListMutableDrawings returns a page of the user's drawings, and whether there
+// are more after it.
+func ListMutableDrawings(
+	db *sql.DB, userId int, options ListMutableDrawingsOptions,
+) ([]MutableDrawingRow, bool, error) {
 	var results []MutableDrawingRow
+	column := mutableDrawingSortColumns[options.Sort]
+	direction, comparison := "ASC", ">"
+	if options.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	where, args := mutableDrawingsFilter(userId, options)
+	if options.Cursor != nil {
+		// The id breaks ties, e.g. drawings created in the same second.
+		where += fmt.Sprintf(
+			" AND (%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, comparison,
+		)
+		args = append(args, options.Cursor.Value, options.Cursor.Value, options.Cursor.Id)
+	}
+	// One extra row tells us whether there is another page.
+	args = append(args, options.Limit+1)
+
 	rows, err := db.Query(
-		"SELECT id, name, created_at FROM mutable_drawings WHERE user_id = ? ORDER BY created_at DESC LIMIT 100",
-		userId,
+		fmt.Sprintf(
+			`SELECT id, name, created_at, updated_at, folder_id, publish_token
+			FROM mutable_drawings WHERE %s
+			ORDER BY %s %s, id %s LIMIT ?`,
+			where, column, direction, direction,
+		),
+		args...,
 	)
-	defer rows.Close()
 	if err != nil {
-		return results, err
+		return results, false, err
 	}
-	var (
-		id        int
-		name      string
-		createdAt string
-	)
+	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&id, &name, &createdAt)
+		var row MutableDrawingRow
+		err := rows.Scan(
+			&row.Id, &row.Name, &row.CreatedAt, &row.UpdatedAt, &row.FolderId, &row.PublishToken,
+		)
 		if err != nil {
-			return results, err
+			return results, false, err
 		}
-		results = append(results, MutableDrawingRow{id, name, createdAt})
+		results = append(results, row)
 	}
-	return results, nil
+	if err := rows.Err(); err != nil {
+		return results, false, err
+	}
+	if len(results) > options.Limit {
+		return results[:options.Limit], true, nil
+	}
+	return results, false, nil
+}
+
+func CountMutableDrawings(db *sql.DB, userId int, options ListMutableDrawingsOptions) (int, error) {
+	var total int
+	where, args := mutableDrawingsFilter(userId, options)
+	err := db.QueryRow("SELECT COUNT(*) FROM mutable_drawings WHERE "+where, args...).Scan(&total)
+	return total, err
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const editLinkTokenLength = 32
+
+// EditLinkRow is a capability to edit one drawing without a session. Only a
+// hash of its token is stored.
+type EditLinkRow struct {
+	Id        int
+	DrawingId int
+	UserId    int
+	CreatedAt string
+	ExpiresAt sql.NullString
+	RevokedAt sql.NullString
+}
+
+type MutableDrawingHistoryRow struct {
+	EditedAt   string
+	EditLinkId sql.NullInt64
+}
+
+// CreateEditLink issues an edit link for the user's drawing, returning its id
+// and token. The token is empty if there is no such drawing.
+func CreateEditLink(db *sql.DB, drawingId int, userId int, expiresAt *time.Time) (int, string, error) {
+	token := RandomBase62(editLinkTokenLength)
+	var expiry sql.NullTime
+	if expiresAt != nil {
+		expiry = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	res, err := db.Exec(
+		`INSERT INTO edit_links (drawing_id, token_hash, expires_at)
+		SELECT id, ?, ? FROM mutable_drawings
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		Hash(token),
+		expiry,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return -1, "", err
+	}
+	if created, err := res.RowsAffected(); err != nil || created == 0 {
+		return -1, "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return int(id), token, nil
+}
+
+func ListEditLinks(db *sql.DB, drawingId int, userId int) ([]EditLinkRow, error) {
+	var results []EditLinkRow
+	rows, err := db.Query(
+		`SELECT l.id, l.drawing_id, d.user_id, l.created_at, l.expires_at, l.revoked_at
+		FROM edit_links l JOIN mutable_drawings d ON d.id = l.drawing_id
+		WHERE l.drawing_id = ? AND d.user_id = ? AND d.deleted_at IS NULL
+		ORDER BY l.id DESC`,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row EditLinkRow
+		err := rows.Scan(
+			&row.Id, &row.DrawingId, &row.UserId, &row.CreatedAt, &row.ExpiresAt, &row.RevokedAt,
+		)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func RevokeEditLink(db *sql.DB, linkId int, drawingId int, userId int) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE edit_links l JOIN mutable_drawings d ON d.id = l.drawing_id
+		SET l.revoked_at = UTC_TIMESTAMP()
+		WHERE l.id = ? AND l.drawing_id = ? AND d.user_id = ? AND l.revoked_at IS NULL`,
+		linkId,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return revoked == 1, nil
+}
+
+// GetEditLink finds the link of the token, as long as it is usable: not
+// revoked, not expired, and its drawing not in the trash. Otherwise the row's
+// Id is 0.
+func GetEditLink(db *sql.DB, token string) (EditLinkRow, error) {
+	var row EditLinkRow
+	err := db.QueryRow(
+		`SELECT l.id, l.drawing_id, d.user_id, l.created_at, l.expires_at, l.revoked_at
+		FROM edit_links l JOIN mutable_drawings d ON d.id = l.drawing_id
+		WHERE l.token_hash = ? AND l.revoked_at IS NULL
+		AND (l.expires_at IS NULL OR l.expires_at > UTC_TIMESTAMP())
+		AND d.deleted_at IS NULL`,
+		Hash(token),
+	).Scan(&row.Id, &row.DrawingId, &row.UserId, &row.CreatedAt, &row.ExpiresAt, &row.RevokedAt)
+	if err == nil || err == sql.ErrNoRows {
+		return row, nil
+	}
+	return row, err
+}
+
+func ListMutableDrawingHistory(db *sql.DB, drawingId int, userId int) ([]MutableDrawingHistoryRow, error) {
+	var results []MutableDrawingHistoryRow
+	rows, err := db.Query(
+		`SELECT h.edited_at, h.edit_link_id
+		FROM mutable_drawing_history h JOIN mutable_drawings d ON d.id = h.drawing_id
+		WHERE h.drawing_id = ? AND d.user_id = ? AND d.deleted_at IS NULL
+		ORDER BY h.edited_at DESC, h.id DESC`,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row MutableDrawingHistoryRow
+		if err := rows.Scan(&row.EditedAt, &row.EditLinkId); err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
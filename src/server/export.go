@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+type ExportManifest struct {
+	ExportedAt string                  `json:"exported_at"`
+	Drawings   []ExportManifestDrawing `json:"drawings"`
+	Folders    []ExportManifestFolder  `json:"folders"`
+}
+
+type ExportManifestDrawing struct {
+	Id         int      `json:"id"`
+	Name       string   `json:"name"`
+	File       string   `json:"file"`
+	TextFile   string   `json:"text_file,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	UpdatedAt  string   `json:"updated_at"`
+	FolderId   int      `json:"folder_id,omitempty"`
+	FolderPath string   `json:"folder_path,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	// DeletedAt is set for drawings in the trash, if those are included.
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
+type ExportManifestFolder struct {
+	Id       int    `json:"id"`
+	ParentId int    `json:"parent_id,omitempty"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// SafeFileName reduces a drawing name to something usable in any file system.
+func SafeFileName(name string) string {
+	name = strings.Trim(unsafeFileNameChars.ReplaceAllString(name, "-"), "-.")
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	if name == "" {
+		return "drawing"
+	}
+	return name
+}
+
+// folderPaths maps each folder to its path from the top level, e.g. "a/b".
+func folderPaths(folders []FolderRow) map[int]string {
+	byId := map[int]FolderRow{}
+	for _, folder := range folders {
+		byId[folder.Id] = folder
+	}
+	paths := map[int]string{}
+	for _, folder := range folders {
+		parts := []string{folder.Name}
+		parent := folder.ParentId
+		// Folders can't be moved into themselves, but don't loop forever if so.
+		for depth := 0; parent.Valid && depth < len(folders); depth++ {
+			parentFolder := byId[int(parent.Int64)]
+			parts = append([]string{parentFolder.Name}, parts...)
+			parent = parentFolder.ParentId
+		}
+		paths[folder.Id] = strings.Join(parts, "/")
+	}
+	return paths
+}
+
+type ExportOptions struct {
+	// IncludeText adds each drawing's text (as extracted for search) alongside
+	// it as a .txt file.
+	IncludeText    bool
+	IncludeTrashed bool
+	// Dir is where in the archive the drawings and manifest go.
+	Dir string
+}
+
+// WriteMutableDrawingsExport writes a zip of all the user's drawings to w.
+func WriteMutableDrawingsExport(db *sql.DB, userId int, options ExportOptions, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	if err := AddMutableDrawingsToArchive(db, userId, options, archive); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// AddMutableDrawingsToArchive adds the user's drawings and a manifest of them
+// to the archive. Drawings are read and written one at a time, so the archive
+// is never held in memory.
+func AddMutableDrawingsToArchive(db *sql.DB, userId int, options ExportOptions, archive *zip.Writer) error {
+	exportedAt := time.Now().UTC()
+	folders, err := ListFolders(db, userId)
+	if err != nil {
+		return err
+	}
+	tags, err := GetUserDrawingTags(db, userId)
+	if err != nil {
+		return err
+	}
+	paths := folderPaths(folders)
+
+	// Only the metadata is listed up front. The data is read a drawing at a
+	// time, so a slow download doesn't hold a connection for its duration.
+	var drawings []MutableDrawingRow
+	deletedAts := map[int]string{}
+	rows, err := db.Query(
+		`SELECT id, name, created_at, updated_at, folder_id, IFNULL(deleted_at, '')
+		FROM mutable_drawings WHERE user_id = ? AND (deleted_at IS NULL OR ?) ORDER BY id`,
+		userId,
+		options.IncludeTrashed,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row MutableDrawingRow
+		var deletedAt string
+		err := rows.Scan(&row.Id, &row.Name, &row.CreatedAt, &row.UpdatedAt, &row.FolderId, &deletedAt)
+		if err != nil {
+			return err
+		}
+		drawings = append(drawings, row)
+		deletedAts[row.Id] = deletedAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	create := func(name string) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{
+			Name: path.Join(options.Dir, name), Method: zip.Deflate, Modified: exportedAt,
+		})
+	}
+	manifest := ExportManifest{
+		ExportedAt: exportedAt.Format(time.RFC3339),
+		Drawings:   []ExportManifestDrawing{},
+		Folders:    []ExportManifestFolder{},
+	}
+	for _, row := range drawings {
+		var text string
+		err := db.QueryRow(
+			"SELECT data, IFNULL(text_content, '') FROM mutable_drawings WHERE id = ?", row.Id,
+		).Scan(&row.Data, &text)
+		if err == sql.ErrNoRows {
+			// Purged since it was listed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		base := fmt.Sprintf("drawings/%d-%s", row.Id, SafeFileName(row.Name))
+		entry := ExportManifestDrawing{
+			Id:         row.Id,
+			Name:       row.Name,
+			File:       base + ".json",
+			CreatedAt:  row.CreatedAt,
+			UpdatedAt:  row.UpdatedAt,
+			FolderId:   int(row.FolderId.Int64),
+			FolderPath: paths[int(row.FolderId.Int64)],
+			Tags:       tags[row.Id],
+			DeletedAt:  deletedAts[row.Id],
+		}
+		file, err := create(entry.File)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, row.Data); err != nil {
+			return err
+		}
+		if options.IncludeText {
+			entry.TextFile = base + ".txt"
+			file, err := create(entry.TextFile)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(file, text); err != nil {
+				return err
+			}
+		}
+		manifest.Drawings = append(manifest.Drawings, entry)
+	}
+
+	for _, folder := range folders {
+		manifest.Folders = append(manifest.Folders, ExportManifestFolder{
+			Id:       folder.Id,
+			ParentId: int(folder.ParentId.Int64),
+			Name:     folder.Name,
+			Path:     paths[folder.Id],
+		})
+	}
+	file, err := create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+)
+
+type FolderRow struct {
+	Id        int
+	ParentId  sql.NullInt64
+	Name      string
+	CreatedAt string
+}
+
+// FolderIdOrNull treats 0, which is never a real id, as no folder.
+func FolderIdOrNull(folderId int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(folderId), Valid: folderId > 0}
+}
+
+// folderTreeQuery selects a user's folder and all those nested in it, deepest
+// first.
+const folderTreeQuery = `
+	WITH RECURSIVE tree (id, depth) AS (
+		SELECT id, 0 FROM folders WHERE id = ? AND user_id = ?
+		UNION ALL
+		SELECT folders.id, tree.depth + 1 FROM folders JOIN tree ON folders.parent_id = tree.id
+	)
+	SELECT id FROM tree ORDER BY depth DESC`
+
+func FolderExists(db *sql.DB, folderId int, userId int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(
+		"SELECT 1 FROM folders WHERE id = ? AND user_id = ?", folderId, userId,
+	).Scan(&exists)
+	if err == nil || err == sql.ErrNoRows {
+		return exists, nil
+	}
+	return exists, err
+}
+
+func CreateFolder(db *sql.DB, name string, parentId sql.NullInt64, userId int) (int, error) {
+	res, err := db.Exec(
+		"INSERT INTO folders (user_id, parent_id, name) VALUES (?, ?, ?)",
+		userId,
+		parentId,
+		name,
+	)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), err
+}
+
+func RenameFolder(db *sql.DB, folderId int, name string, userId int) (bool, error) {
+	res, err := db.Exec(
+		"UPDATE folders SET name = ? WHERE id = ? AND user_id = ?",
+		name,
+		folderId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func ListFolders(db *sql.DB, userId int) ([]FolderRow, error) {
+	var results []FolderRow
+	rows, err := db.Query(
+		"SELECT id, parent_id, name, created_at FROM folders WHERE user_id = ? ORDER BY name, id",
+		userId,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row FolderRow
+		if err := rows.Scan(&row.Id, &row.ParentId, &row.Name, &row.CreatedAt); err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// GetFolderTree returns the ids of the user's folder and every folder nested
+// in it, deepest first. It is empty if the user has no such folder.
+func GetFolderTree(db *sql.DB, folderId int, userId int) ([]int, error) {
+	var ids []int
+	rows, err := db.Query(folderTreeQuery, folderId, userId)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// MoveFolder moves the user's folder into another of theirs, or to the top
+// level if the parent is null. Moving a folder into itself or one nested in it
+// is refused.
+func MoveFolder(db *sql.DB, folderId int, parentId sql.NullInt64, userId int) (bool, error) {
+	if parentId.Valid {
+		tree, err := GetFolderTree(db, folderId, userId)
+		if err != nil {
+			return false, err
+		}
+		for _, id := range tree {
+			if int64(id) == parentId.Int64 {
+				return false, nil
+			}
+		}
+		exists, err := FolderExists(db, int(parentId.Int64), userId)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	res, err := db.Exec(
+		"UPDATE folders SET parent_id = ? WHERE id = ? AND user_id = ?",
+		parentId,
+		folderId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	// Nothing is affected if the parent is unchanged, but the folder exists.
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 1 {
+		return affected == 1, err
+	}
+	return FolderExists(db, folderId, userId)
+}
+
+// MoveMutableDrawing moves the user's drawing into one of their folders, or out
+// of any folder if the folder is null.
+func MoveMutableDrawing(db *sql.DB, drawingId int, folderId sql.NullInt64, userId int) (bool, error) {
+	if folderId.Valid {
+		exists, err := FolderExists(db, int(folderId.Int64), userId)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	var exists bool
+	err := db.QueryRow(
+		"SELECT 1 FROM mutable_drawings WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		drawingId,
+		userId,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = db.Exec(
+		"UPDATE mutable_drawings SET folder_id = ? WHERE id = ? AND user_id = ?",
+		folderId,
+		drawingId,
+		userId,
+	)
+	return err == nil, err
+}
+
+// IsFolderEmpty checks whether the folder tree (see GetFolderTree) has any
+// drawings or folders nested in it.
+func IsFolderEmpty(db *sql.DB, tree []int) (bool, error) {
+	if len(tree) > 1 {
+		return false, nil
+	}
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM mutable_drawings WHERE folder_id = ? AND deleted_at IS NULL",
+		tree[0],
+	).Scan(&count)
+	return count == 0, err
+}
+
+// DeleteFolderTree deletes the folder tree (see GetFolderTree), moving all the
+// drawings in it to the trash. They are restored outside of any folder.
+func DeleteFolderTree(db *sql.DB, tree []int, userId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []any{userId}
+	for _, id := range tree {
+		args = append(args, id)
+	}
+	if _, err = tx.Exec(
+		`UPDATE mutable_drawings SET
+		deleted_at = IFNULL(deleted_at, UTC_TIMESTAMP()), folder_id = NULL, updated_at = updated_at
+		WHERE user_id = ? AND folder_id IN (`+SqlPlaceholders(len(tree))+`)`,
+		args...,
+	); err != nil {
+		return err
+	}
+	// Deepest first, so no folder is deleted while another still points to it.
+	for _, id := range tree {
+		if _, err = tx.Exec(
+			"DELETE FROM folders WHERE id = ? AND user_id = ?", id, userId,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	MaxImportFiles    = 1000
+	MaxImportFileSize = 5 << 20
+	// MaxImportSize limits both the upload and the drawings unzipped from it.
+	MaxImportSize = 32 << 20
+)
+
+// ImportUpload is an uploaded file, either a cascii JSON file or a zip of them.
+type ImportUpload struct {
+	Name   string
+	Reader io.Reader
+}
+
+// ImportFile is a drawing read from an upload, yet to be imported.
+type ImportFile struct {
+	File string
+	Name string
+	Data string
+	Tags []string
+}
+
+type ImportResultRow struct {
+	File string
+	Id   int
+	// DuplicateOf is the existing drawing with the same content, if any, in
+	// which case the file wasn't imported again.
+	DuplicateOf int
+}
+
+// DrawingHash hashes a drawing's content, ignoring how its JSON happens to be
+// formatted, so the same drawing always has the same hash.
+func DrawingHash(data string) string {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		return Hash(data)
+	}
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return Hash(data)
+	}
+	return Hash(string(canonical))
+}
+
+// ReadImportFile reads one uploaded cascii JSON file, named after the file.
+func ReadImportFile(name string, reader io.Reader) (ImportFile, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, MaxImportFileSize+1))
+	if err != nil {
+		return ImportFile{}, err
+	}
+	if len(data) > MaxImportFileSize {
+		return ImportFile{}, errors.New("file too large")
+	}
+	return ImportFile{
+		File: name,
+		Name: strings.TrimSuffix(path.Base(name), path.Ext(name)),
+		Data: string(data),
+	}, nil
+}
+
+// ReadImportFiles reads the cascii JSON files from either uploaded files or
+// zip archives of them. Anything else, such as the .txt files of an export,
+// is ignored. A manifest.json, as written by an export, restores the names
+// and tags of the files it lists.
+func ReadImportFiles(uploads []ImportUpload) ([]ImportFile, error) {
+	var imports []ImportFile
+	var manifest *ExportManifest
+	total := 0
+	add := func(name string, reader io.Reader) error {
+		if path.Base(name) == "manifest.json" {
+			manifest = &ExportManifest{}
+			return json.NewDecoder(io.LimitReader(reader, MaxImportFileSize)).Decode(manifest)
+		}
+		if path.Ext(name) != ".json" {
+			return nil
+		}
+		if len(imports) == MaxImportFiles {
+			return fmt.Errorf("more than %d files", MaxImportFiles)
+		}
+		file, err := ReadImportFile(name, reader)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if total += len(file.Data); total > MaxImportSize {
+			return errors.New("import too large")
+		}
+		imports = append(imports, file)
+		return nil
+	}
+
+	for _, upload := range uploads {
+		if path.Ext(upload.Name) != ".zip" {
+			if err := add(upload.Name, upload.Reader); err != nil {
+				return imports, err
+			}
+			continue
+		}
+		archiveData, err := io.ReadAll(io.LimitReader(upload.Reader, MaxImportSize))
+		if err != nil {
+			return imports, err
+		}
+		archive, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+		if err != nil {
+			return imports, fmt.Errorf("%s: %w", upload.Name, err)
+		}
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				continue
+			}
+			entryReader, err := entry.Open()
+			if err != nil {
+				return imports, fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			err = add(entry.Name, entryReader)
+			entryReader.Close()
+			if err != nil {
+				return imports, err
+			}
+		}
+	}
+
+	if manifest != nil {
+		byFile := map[string]ExportManifestDrawing{}
+		for _, drawing := range manifest.Drawings {
+			byFile[drawing.File] = drawing
+		}
+		for i, file := range imports {
+			if drawing, ok := byFile[file.File]; ok {
+				imports[i].Name = drawing.Name
+				imports[i].Tags = drawing.Tags
+			}
+		}
+	}
+	return imports, nil
+}
+
+// ImportMutableDrawings creates a drawing of the user's for each file, all or
+// nothing. Files with the same content as an existing drawing, or an earlier
+// file, are skipped, which also makes it safe to retry an import.
+func ImportMutableDrawings(db *sql.DB, files []ImportFile, userId int) ([]ImportResultRow, error) {
+	var results []ImportResultRow
+	tx, err := db.Begin()
+	if err != nil {
+		return results, err
+	}
+	defer tx.Rollback()
+
+	for _, file := range files {
+		result := ImportResultRow{File: file.File}
+		hash := DrawingHash(file.Data)
+		err := tx.QueryRow(
+			`SELECT id FROM mutable_drawings
+			WHERE user_id = ? AND data_hash = ? AND deleted_at IS NULL ORDER BY id LIMIT 1`,
+			userId,
+			hash,
+		).Scan(&result.DuplicateOf)
+		if err != nil && err != sql.ErrNoRows {
+			return results, err
+		}
+		if result.DuplicateOf > 0 {
+			results = append(results, result)
+			continue
+		}
+		res, err := tx.Exec(
+			`INSERT INTO mutable_drawings (user_id, name, data, text_content, data_hash)
+			VALUES (?, ?, ?, ?, ?)`,
+			userId,
+			file.Name,
+			file.Data,
+			ExtractDrawingText(file.Data),
+			hash,
+		)
+		if err != nil {
+			return results, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return results, err
+		}
+		result.Id = int(id)
+		if err := TagMutableDrawingTx(tx, result.Id, NormaliseTags(file.Tags), userId); err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, tx.Commit()
+}
+
+// HashMutableDrawingsData hashes the data of drawings saved before it was
+// hashed on every save, a batch at a time. It returns how many it did.
+func HashMutableDrawingsData(db *sql.DB, batchSize int) (int, error) {
+	rows, err := db.Query(
+		"SELECT id, data FROM mutable_drawings WHERE data_hash IS NULL LIMIT ?", batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	hashes := map[int]string{}
+	for rows.Next() {
+		var id int
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes[id] = DrawingHash(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, hash := range hashes {
+		if _, err := db.Exec(
+			"UPDATE mutable_drawings SET data_hash = ?, updated_at = updated_at WHERE id = ?",
+			hash,
+			id,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const inviteCodeLength = 24
+
+// MaxUserInviteUses limits how many people an invite issued by someone other
+// than an admin can let in.
+const MaxUserInviteUses = 20
+
+// Registration modes, for who can sign up with a password. Users coming
+// through an identity provider or proxy are governed by those instead.
+const (
+	RegistrationOpen = "open"
+	// RegistrationDomain only lets in RegistrationDomains, or those invited.
+	RegistrationDomain = "domain"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var RegistrationMode = LoadRegistrationMode(os.Getenv("REGISTRATION_MODE"))
+var RegistrationDomains = SplitEnvList(os.Getenv("REGISTRATION_DOMAINS"))
+
+// AdminEmails are the users who can see and revoke everyone's invites, and
+// issue them without limits.
+var AdminEmails = SplitEnvList(os.Getenv("ADMIN_EMAILS"))
+
+type InviteRow struct {
+	Id        int
+	UserId    int
+	IssuedBy  string
+	MaxUses   sql.NullInt64
+	Uses      int
+	ExpiresAt sql.NullString
+	RevokedAt sql.NullString
+	CreatedAt string
+	Invitees  []string
+}
+
+// LoadRegistrationMode defaults to open, as before there were modes. Anything
+// unknown closes registration rather than guessing.
+func LoadRegistrationMode(mode string) string {
+	switch mode {
+	case "":
+		return RegistrationOpen
+	case RegistrationOpen, RegistrationDomain, RegistrationInvite, RegistrationClosed:
+		return mode
+	}
+	log.Printf("Unknown REGISTRATION_MODE %q, closing registration", mode)
+	return RegistrationClosed
+}
+
+// SplitEnvList splits a comma separated list, ignoring blanks and case.
+func SplitEnvList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func IsRegistrationDomain(email string) bool {
+	_, domain, _ := strings.Cut(email, "@")
+	return slices.Contains(RegistrationDomains, strings.ToLower(domain))
+}
+
+// IsAdmin is only true once the user has verified their email, so an admin's
+// email can't be signed up for by someone else.
+func IsAdmin(db *sql.DB, userId int) (bool, error) {
+	var email string
+	err := db.QueryRow(
+		"SELECT email FROM users WHERE id = ? AND verified_at IS NOT NULL", userId,
+	).Scan(&email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return slices.Contains(AdminEmails, strings.ToLower(email)), err
+}
+
+// CreateInvite issues an invite from the user, returning its id and code. A
+// nil maxUses means it can be used any number of times.
+func CreateInvite(db *sql.DB, userId int, maxUses *int, expiresAt *time.Time) (int, string, error) {
+	code := RandomBase62(inviteCodeLength)
+	var uses sql.NullInt64
+	if maxUses != nil {
+		uses = sql.NullInt64{Int64: int64(*maxUses), Valid: true}
+	}
+	var expiry sql.NullTime
+	if expiresAt != nil {
+		expiry = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	res, err := db.Exec(
+		"INSERT INTO invites (user_id, code_hash, max_uses, expires_at) VALUES (?, ?, ?, ?)",
+		userId,
+		Hash(code),
+		uses,
+		expiry,
+	)
+	if err != nil {
+		return -1, "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return int(id), code, nil
+}
+
+// ListInvites lists the invites issued by the user, or everyone's if all is
+// set, along with who signed up with each.
+func ListInvites(db *sql.DB, userId int, all bool) ([]InviteRow, error) {
+	var results []InviteRow
+	rows, err := db.Query(
+		`SELECT i.id, i.user_id, u.email, i.max_uses, i.uses, i.expires_at, i.revoked_at,
+		i.created_at, IFNULL(GROUP_CONCAT(invitee.email ORDER BY invitee.id SEPARATOR ' '), '')
+		FROM invites i JOIN users u ON u.id = i.user_id
+		LEFT JOIN users invitee ON invitee.invite_id = i.id
+		WHERE i.user_id = ? OR ?
+		GROUP BY i.id ORDER BY i.id DESC`,
+		userId,
+		all,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row InviteRow
+		var invitees string
+		err := rows.Scan(
+			&row.Id, &row.UserId, &row.IssuedBy, &row.MaxUses, &row.Uses,
+			&row.ExpiresAt, &row.RevokedAt, &row.CreatedAt, &invitees,
+		)
+		if err != nil {
+			return results, err
+		}
+		// Emails can't contain spaces.
+		row.Invitees = strings.Fields(invitees)
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// RevokeInvite revokes the user's invite, or anyone's if all is set.
+func RevokeInvite(db *sql.DB, inviteId int, userId int, all bool) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE invites SET revoked_at = UTC_TIMESTAMP()
+		WHERE id = ? AND (user_id = ? OR ?) AND revoked_at IS NULL`,
+		inviteId,
+		userId,
+		all,
+	)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return revoked == 1, nil
+}
+
+// usableInvite is the condition on an invite for it to get someone in.
+const usableInvite = `revoked_at IS NULL
+	AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())
+	AND (max_uses IS NULL OR uses < max_uses)`
+
+// IsInviteUsable tells whether the code is of an invite that can still get
+// someone in, without using it.
+func IsInviteUsable(db *sql.DB, code string) (bool, error) {
+	var usable bool
+	err := db.QueryRow(
+		"SELECT 1 FROM invites WHERE code_hash = ? AND "+usableInvite, Hash(code),
+	).Scan(&usable)
+	if err == nil || err == sql.ErrNoRows {
+		return usable, nil
+	}
+	return usable, err
+}
+
+// CreateInvitedUser creates a user with the invite of the code, using it up.
+// It returns -1 if the invite is unknown, revoked, expired or used up.
+func CreateInvitedUser(db *sql.DB, email string, password string, code string) (int, error) {
+	password, err := HashPassword(password)
+	if err != nil {
+		return -1, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	var inviteId int
+	err = tx.QueryRow(
+		"SELECT id FROM invites WHERE code_hash = ? AND "+usableInvite+" FOR UPDATE",
+		Hash(code),
+	).Scan(&inviteId)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec("UPDATE invites SET uses = uses + 1 WHERE id = ?", inviteId); err != nil {
+		return -1, err
+	}
+	res, err := tx.Exec(
+		"INSERT INTO users (email, password, invite_id) VALUES (?, ?, ?)",
+		email,
+		password,
+		inviteId,
+	)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), tx.Commit()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(db *sql.DB) error
+}
+
+var PurgeImmutableDrawingsJob = Job{
+	Name:     "purge immutable drawings",
+	Interval: 10 * time.Minute,
+	Run: func(db *sql.DB) error {
+		purged, err := PurgeGoneImmutableDrawings(db)
+		if err == nil && purged > 0 {
+			log.Printf("Purged %d expired immutable drawings", purged)
+		}
+		return err
+	},
+}
+
+var PurgeTrashJob = Job{
+	Name:     "purge trash",
+	Interval: time.Hour,
+	Run: func(db *sql.DB) error {
+		purged, err := PurgeExpiredTrash(db)
+		if err == nil && purged > 0 {
+			log.Printf("Purged %d mutable drawings from the trash", purged)
+		}
+		return err
+	},
+}
+
+var IndexMutableDrawingsTextJob = Job{
+	Name:     "index mutable drawings text",
+	Interval: time.Hour,
+	Run: func(db *sql.DB) error {
+		for {
+			indexed, err := IndexMutableDrawingsText(db, 100)
+			if err != nil || indexed == 0 {
+				return err
+			}
+			log.Printf("Indexed the text of %d mutable drawings", indexed)
+		}
+	},
+}
+
+var HashMutableDrawingsDataJob = Job{
+	Name:     "hash mutable drawings data",
+	Interval: time.Hour,
+	Run: func(db *sql.DB) error {
+		for {
+			hashed, err := HashMutableDrawingsData(db, 100)
+			if err != nil || hashed == 0 {
+				return err
+			}
+			log.Printf("Hashed the data of %d mutable drawings", hashed)
+		}
+	},
+}
+
+var PurgeDeletedUsersJob = Job{
+	Name:     "purge deleted users",
+	Interval: time.Hour,
+	Run: func(db *sql.DB) error {
+		purged, err := PurgeDeletedUsers(db)
+		if err == nil && purged > 0 {
+			log.Printf("Deleted %d users past their grace period", purged)
+		}
+		return err
+	},
+}
+
+var PurgeLoginLinksJob = Job{
+	Name:     "purge login links",
+	Interval: time.Hour,
+	Run: func(db *sql.DB) error {
+		purged, err := PurgeLoginLinks(db)
+		if err == nil && purged > 0 {
+			log.Printf("Purged %d used or expired login links", purged)
+		}
+		return err
+	},
+}
+
+var DataExportsJob = Job{
+	Name:     "data exports",
+	Interval: time.Minute,
+	Run: func(db *sql.DB) error {
+		ran, err := RunDataExports(db)
+		if ran > 0 {
+			log.Printf("Ran %d data exports", ran)
+		}
+		if err != nil {
+			return err
+		}
+		purged, err := PurgeExpiredDataExports(db)
+		if err == nil && purged > 0 {
+			log.Printf("Purged %d expired data exports", purged)
+		}
+		return err
+	},
+}
+
+// StartJobs runs each job in the background straight away, then every
+// interval. A failing run is logged and simply retried on the next tick.
+func StartJobs(db *sql.DB, jobs ...Job) {
+	for _, job := range jobs {
+		go func(job Job) {
+			ticker := time.NewTicker(job.Interval)
+			defer ticker.Stop()
+			for {
+				if err := job.Run(db); err != nil {
+					log.Printf("Job %q failed: %s", job.Name, err)
+				}
+				<-ticker.C
+			}
+		}(job)
+	}
+}
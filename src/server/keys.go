@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+const base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// KeyGenerator proposes short keys for a drawing, given its (hex) hash. Keys
+// are tried in order of attempt until a free one is found, so a generator must
+// keep proposing new keys for as long as it's asked.
+type KeyGenerator interface {
+	Key(hash string, attempt int) string
+}
+
+// Base62KeyGenerator uses ever longer prefixes of the base62 encoded hash,
+// from MinLength up to MaxLength. Past that, it falls back to random suffixes.
+type Base62KeyGenerator struct {
+	MinLength int
+	MaxLength int
+}
+
+var ShortKeyGenerator KeyGenerator = NewBase62KeyGenerator(GetEnvInt("SHORT_KEY_MIN_LENGTH", 5))
+
+func NewBase62KeyGenerator(minLength int) Base62KeyGenerator {
+	return Base62KeyGenerator{MinLength: minLength, MaxLength: minLength + 5}
+}
+
+func (generator Base62KeyGenerator) Key(hash string, attempt int) string {
+	encoded := EncodeBase62(hash)
+	length := generator.MinLength + attempt
+	if length <= generator.MaxLength && length <= len(encoded) {
+		return encoded[:length]
+	}
+	// Conflicting on every prefix is surely impossible, but a random suffix
+	// guarantees we find a free key eventually.
+	prefixLength := min(generator.MinLength, len(encoded))
+	return encoded[:prefixLength] + RandomBase62(generator.MaxLength-prefixLength)
+}
+
+func EncodeBase62(hash string) string {
+	bytes, err := hex.DecodeString(hash)
+	if err != nil {
+		// Not hex, but still perfectly usable as the source of a key.
+		bytes = []byte(hash)
+	}
+	return new(big.Int).SetBytes(bytes).Text(62)
+}
+
+func RandomBase62(length int) string {
+	var builder strings.Builder
+	base := big.NewInt(int64(len(base62Alphabet)))
+	for range length {
+		i, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			panic(err)
+		}
+		builder.WriteByte(base62Alphabet[i.Int64()])
+	}
+	return builder.String()
+}
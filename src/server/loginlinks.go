@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const loginLinkTokenLength = 32
+
+// LoginLinkLifetime is how long an emailed login link can be used for.
+var LoginLinkLifetime = 15 * time.Minute
+
+// CreateLoginLink issues a single use login link for the user, returning its
+// token. Only a hash of the token is stored. The token is empty if a link was
+// issued within MailResendInterval, as it's mailed to the user.
+func CreateLoginLink(db *sql.DB, userId int) (string, error) {
+	var recent bool
+	err := db.QueryRow(
+		`SELECT 1 FROM login_links
+		WHERE user_id = ? AND created_at > CURRENT_TIMESTAMP() - INTERVAL ? SECOND LIMIT 1`,
+		userId,
+		MailResendInterval.Seconds(),
+	).Scan(&recent)
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	token := RandomBase62(loginLinkTokenLength)
+	_, err = db.Exec(
+		"INSERT INTO login_links (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userId,
+		Hash(token),
+		time.Now().Add(LoginLinkLifetime).UTC(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RedeemLoginLink uses up the link of the token, returning its user. If the
+// link is unknown, expired or already used, it returns -1. The link was sent
+// to the user's email, so redeeming it verifies that too, taking the account
+// back from whoever may have signed up with the email before.
+func RedeemLoginLink(db *sql.DB, token string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	var linkId int
+	userId := -1
+	err = tx.QueryRow(
+		`SELECT id, user_id FROM login_links
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > UTC_TIMESTAMP()
+		FOR UPDATE`,
+		Hash(token),
+	).Scan(&linkId, &userId)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE login_links SET used_at = UTC_TIMESTAMP() WHERE id = ?", linkId,
+	); err != nil {
+		return -1, err
+	}
+	if err := VerifyUserEmailOwner(tx, userId); err != nil {
+		return -1, err
+	}
+	return userId, tx.Commit()
+}
+
+// PurgeLoginLinks deletes the links that can no longer be used. It returns
+// how many were deleted.
+func PurgeLoginLinks(db *sql.DB) (int, error) {
+	res, err := db.Exec(
+		"DELETE FROM login_links WHERE expires_at <= UTC_TIMESTAMP() OR used_at IS NOT NULL",
+	)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BaseUrl is where the server is reached from, for links sent in mail.
+var BaseUrl = strings.TrimSuffix(GetEnv("BASE_URL", "http://localhost:8000"), "/")
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// LogMailer only logs mail, which is enough to follow links locally.
+type LogMailer struct{}
+
+func (mailer LogMailer) Send(mail Mail) error {
+	log.Printf("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// FileMailer writes each mail to a file in a directory per recipient, so that
+// tests can read what was sent.
+type FileMailer struct {
+	Dir string
+}
+
+func (mailer FileMailer) Send(mail Mail) error {
+	dir := filepath.Join(mailer.Dir, mail.To)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%d.txt", time.Now().UnixNano()))
+	return os.WriteFile(name, []byte(mail.Subject+"\n\n"+mail.Body), 0o644)
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (mailer SMTPMailer) Send(mail Mail) error {
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		host := strings.Split(mailer.Addr, ":")[0]
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, host)
+	}
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		mailer.From, mail.To, mail.Subject, mail.Body,
+	)
+	return smtp.SendMail(mailer.Addr, auth, mailer.From, []string{mail.To}, []byte(message))
+}
+
+// NewMailer picks a mailer from the environment: SMTP if MAIL_SMTP_ADDR is
+// set, files if MAIL_DIR is, and otherwise the log.
+func NewMailer() Mailer {
+	if addr := os.Getenv("MAIL_SMTP_ADDR"); addr != "" {
+		return SMTPMailer{
+			Addr:     addr,
+			From:     GetEnv("MAIL_FROM", "noreply@cascii.app"),
+			Username: os.Getenv("MAIL_SMTP_USERNAME"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+		}
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return FileMailer{Dir: dir}
+	}
+	return LogMailer{}
+}
+
+var DefaultMailer = NewMailer()
@@ -16,6 +16,9 @@ func AddMainRoutes(router *mux.Router) {
 	router.PathPrefix("/static/").Handler(
 		http.StripPrefix("/static/", http.FileServer(http.Dir("./frontend"))),
 	)
+	// Everything else (short keys, slugs, published links at /p/{token}, edit
+	// links at /e/{token}, login links at /l/{token} and the 2FA step of
+	// provider logins at /m/{token}) is routed by the frontend.
 	router.HandleFunc("/{any:.*}",
 		func(w http.ResponseWriter, r *http.Request) {
 			http.ServeFile(w, r, "./frontend/cascii-core/cascii.html")
@@ -24,6 +27,16 @@ func AddMainRoutes(router *mux.Router) {
 }
 
 func main() {
+	var err error
+	ProxyAuth, err = LoadProxyAuth(os.Getenv("PROXY_AUTH_HEADER"), os.Getenv("PROXY_AUTH_TRUSTED_CIDRS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	BreachedPasswords, err = LoadBreachedPasswords(os.Getenv("BREACHED_PASSWORDS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	dbFactory := DbFactory{maxConns: 5, maxIdleConns: 5}
 	dbClient := dbFactory.Get()
 	defer dbClient.Close()
@@ -33,8 +46,22 @@ func main() {
 	AddApiRoutes(router, &Servicers{db: dbClient})
 	AddMainRoutes(router)
 
+	StartJobs(
+		dbClient,
+		PurgeImmutableDrawingsJob,
+		PurgeTrashJob,
+		IndexMutableDrawingsTextJob,
+		HashMutableDrawingsDataJob,
+		PurgeDeletedUsersJob,
+		DataExportsJob,
+		PurgeLoginLinksJob,
+	)
+
 	http.Handle("/", router)
 
-	log.Printf("Starting server - prod: %t", IsProd())
+	log.Printf(
+		"Starting server - prod: %t, proxy auth: %t, registration: %s, breached passwords: %d",
+		IsProd(), ProxyAuth != nil, RegistrationMode, len(BreachedPasswords),
+	)
 	log.Fatal(http.ListenAndServe(":8000", nil))
 }
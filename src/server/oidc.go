@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OidcProvider is an OpenID Connect identity provider users can log in with,
+// configured as a JSON list of them in OIDC_PROVIDERS.
+type OidcProvider struct {
+	// Name identifies the provider in its login URLs.
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	// AllowedDomains, if any, are the only email domains let in.
+	AllowedDomains []string `json:"allowed_domains"`
+	// Provision creates an account on a user's first login, rather than only
+	// letting in those who already have one.
+	Provision bool `json:"provision"`
+	// RedirectUri defaults to the callback under BaseUrl.
+	RedirectUri string `json:"redirect_uri"`
+
+	mutex     sync.Mutex
+	discovery *OidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+// OidcDiscovery is the part of a provider's discovery document we need.
+type OidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type OidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      OidcAudience `json:"aud"`
+	Expiry        int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified bool         `json:"email_verified"`
+}
+
+// OidcAudience is either a single client id or a list of them.
+type OidcAudience []string
+
+func (a *OidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = OidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var OidcProviders = LoadOidcProviders(os.Getenv("OIDC_PROVIDERS"))
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+func LoadOidcProviders(config string) map[string]*OidcProvider {
+	providers := map[string]*OidcProvider{}
+	if config == "" {
+		return providers
+	}
+	var list []*OidcProvider
+	if err := json.Unmarshal([]byte(config), &list); err != nil {
+		log.Printf("OIDC_PROVIDERS is not valid JSON, ignoring it: %s", err)
+		return providers
+	}
+	for _, provider := range list {
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = provider.Name
+		}
+		providers[provider.Name] = provider
+	}
+	return providers
+}
+
+func (p *OidcProvider) RedirectUrl() string {
+	if p.RedirectUri != "" {
+		return p.RedirectUri
+	}
+	return BaseUrl + "/api/user/oidc/" + url.PathEscape(p.Name) + "/callback"
+}
+
+// Discover fetches the provider's discovery document, once.
+func (p *OidcProvider) Discover() (*OidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var discovery OidcDiscovery
+	err := getOidcJson(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q is not %q", discovery.Issuer, p.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// AuthCodeUrl is where to send the user to log in, asking for a code back.
+func (p *OidcProvider) AuthCodeUrl(state string, nonce string, verifier string) (string, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientId},
+		"redirect_uri":          {p.RedirectUrl()},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {PkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func PkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Exchange redeems the code for the user's verified claims.
+func (p *OidcProvider) Exchange(code string, verifier string, nonce string) (OidcClaims, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return OidcClaims{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectUrl()},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientId},
+	}
+	request, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OidcClaims{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+	}
+	response, err := oidcHttpClient.Do(request)
+	if err != nil {
+		return OidcClaims{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return OidcClaims{}, fmt.Errorf("token endpoint returned %d: %s", response.StatusCode, body)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return OidcClaims{}, err
+	}
+	return p.VerifyIdToken(tokens.IdToken, nonce)
+}
+
+// VerifyIdToken checks the ID token was signed by the provider, for us, for
+// this login, and hasn't expired, returning its claims.
+func (p *OidcProvider) VerifyIdToken(token string, nonce string) (OidcClaims, error) {
+	var claims OidcClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	if err := verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return claims, err
+	}
+
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, errors.New("ID token is from another issuer")
+	case !slices.Contains(claims.Audience, p.ClientId):
+		return claims, errors.New("ID token is for another client")
+	// A minute's leeway for clock skew.
+	case time.Now().Add(-time.Minute).Unix() > claims.Expiry:
+		return claims, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return claims, errors.New("ID token is for another login")
+	case claims.Subject == "":
+		return claims, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// key finds the provider's signing key, refetching them if it's new to us, as
+// providers rotate them.
+func (p *OidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mutex.Lock()
+	key, ok := p.keys[kid]
+	p.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getOidcJson(discovery.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.mutex.Lock()
+	p.keys = keys
+	p.mutex.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key %q", kid)
+}
+
+func (jwk jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(bytes), err
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := decode(jwk.N)
+		e, err2 := decode(jwk.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err1 := decode(jwk.X)
+		y, err2 := decode(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 needs an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errors.New("ES256 needs an EC key")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func decodeJwtPart(part string, into any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+func getOidcJson(url string, into any) error {
+	response, err := oidcHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(into)
+}
+
+func (p *OidcProvider) AllowsEmail(email string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range p.AllowedDomains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrOidcDomainNotAllowed = errors.New("email domain not allowed")
+	ErrOidcEmailNotVerified = errors.New("email not verified by the provider")
+	ErrOidcNoAccount        = errors.New("no account for the email")
+)
+
+// ResolveOidcUser finds the user the provider's claims are for: the one
+// already linked to the identity, or else the one with its verified email,
+// who is then linked to it. Failing that, a user is created if the provider
+// provisions them. The errors above say why there's no user.
+func ResolveOidcUser(db *sql.DB, provider *OidcProvider, claims OidcClaims) (int, error) {
+	if !provider.AllowsEmail(claims.Email) {
+		return -1, ErrOidcDomainNotAllowed
+	}
+	userId := -1
+	err := db.QueryRow(
+		"SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?",
+		provider.Name,
+		claims.Subject,
+	).Scan(&userId)
+	if err != nil && err != sql.ErrNoRows {
+		return -1, err
+	}
+	if userId != -1 {
+		_, err := db.Exec(
+			`UPDATE user_identities SET email = ?, last_login_at = UTC_TIMESTAMP()
+			WHERE provider = ? AND subject = ?`,
+			claims.Email,
+			provider.Name,
+			claims.Subject,
+		)
+		return userId, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return -1, ErrOidcEmailNotVerified
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT id FROM users WHERE email = ? FOR UPDATE", claims.Email).Scan(&userId)
+	if err != nil && err != sql.ErrNoRows {
+		return -1, err
+	}
+	if userId == -1 {
+		if !provider.Provision {
+			return -1, ErrOidcNoAccount
+		}
+		// Without a password, they can only log in through a provider or a
+		// login link.
+		res, err := tx.Exec(
+			"INSERT INTO users (email, password, verified_at) VALUES (?, '', UTC_TIMESTAMP())",
+			claims.Email,
+		)
+		if err != nil {
+			return -1, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return -1, err
+		}
+		userId = int(id)
+	}
+	if err := VerifyUserEmailOwner(tx, userId); err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES (?, ?, ?, ?, UTC_TIMESTAMP())`,
+		userId,
+		provider.Name,
+		claims.Subject,
+		claims.Email,
+	); err != nil {
+		return -1, err
+	}
+	return userId, tx.Commit()
+}
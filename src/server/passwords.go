@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MinPasswordLength = 5
+
+// PasswordHasher is one algorithm for hashing passwords. Hashes are stored in
+// the modular crypt format, such as "$2a$10$..." or "$argon2id$v=19$...",
+// which says what made them and with what parameters, so older hashes can
+// still be checked after the preferred hasher changes.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Check is false for hashes made by other algorithms.
+	Check(hash string, password string) bool
+	// IsCurrent tells whether the hash was made by this hasher as it's set up
+	// now, or should be replaced next time the password is known.
+	IsCurrent(hash string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (hasher BcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	return string(bytes), err
+}
+
+func (hasher BcryptHasher) Check(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (hasher BcryptHasher) IsCurrent(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == hasher.Cost
+}
+
+type Argon2idHasher struct {
+	// Memory is in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+const argon2idSaltLength = 16
+const argon2idKeyLength = 32
+
+func (hasher Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, argon2idKeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		hasher.Memory,
+		hasher.Time,
+		hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// parse reads the parameters, salt and key out of the hash.
+func (Argon2idHasher) parse(hash string) (Argon2idHasher, []byte, []byte, bool) {
+	var params Argon2idHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, false
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[4])
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+	return params, salt, key, true
+}
+
+func (hasher Argon2idHasher) Check(hash string, password string) bool {
+	params, salt, key, ok := hasher.parse(hash)
+	if !ok {
+		return false
+	}
+	other := argon2.IDKey(
+		[]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)),
+	)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (hasher Argon2idHasher) IsCurrent(hash string) bool {
+	params, _, key, ok := hasher.parse(hash)
+	return ok && params == hasher && len(key) == argon2idKeyLength
+}
+
+// PasswordHashers are all the hashers passwords may have been hashed with.
+var PasswordHashers = []PasswordHasher{
+	BcryptHasher{Cost: GetEnvInt("PASSWORD_BCRYPT_COST", bcrypt.DefaultCost)},
+	// The defaults are those OWASP recommends.
+	Argon2idHasher{
+		Memory:  uint32(GetEnvInt("PASSWORD_ARGON2ID_MEMORY_KIB", 19*1024)),
+		Time:    uint32(GetEnvInt("PASSWORD_ARGON2ID_TIME", 2)),
+		Threads: uint8(GetEnvInt("PASSWORD_ARGON2ID_THREADS", 1)),
+	},
+}
+
+// PreferredPasswordHasher hashes new passwords, and replaces the hashes of
+// others as users log in.
+var PreferredPasswordHasher = LoadPreferredPasswordHasher(GetEnv("PASSWORD_HASHER", "argon2id"))
+
+func LoadPreferredPasswordHasher(name string) PasswordHasher {
+	switch name {
+	case "bcrypt":
+		return PasswordHashers[0]
+	case "argon2id":
+		return PasswordHashers[1]
+	}
+	log.Printf("Unknown PASSWORD_HASHER %q, using argon2id", name)
+	return PasswordHashers[1]
+}
+
+func HashPassword(password string) (string, error) {
+	return PreferredPasswordHasher.Hash(password)
+}
+
+func CheckPassword(hash string, password string) bool {
+	for _, hasher := range PasswordHashers {
+		if hasher.Check(hash, password) {
+			return true
+		}
+	}
+	return false
+}
+
+func PasswordNeedsRehash(hash string) bool {
+	return !PreferredPasswordHasher.IsCurrent(hash)
+}
+
+// BreachedPasswords are passwords known to have leaked, which can't be chosen
+// as they'll be among the first anyone tries. It's empty unless
+// BREACHED_PASSWORDS_FILE is set.
+var BreachedPasswords = map[string]struct{}{}
+
+// LoadBreachedPasswords reads a file of one password per line, as in the
+// lists of the most common leaked passwords.
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	passwords := map[string]struct{}{}
+	if path == "" {
+		return passwords, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimRight(scanner.Text(), "\r"); password != "" {
+			passwords[password] = struct{}{}
+		}
+	}
+	return passwords, scanner.Err()
+}
+
+// CheckNewPassword returns why the password can't be used, if it can't.
+func CheckNewPassword(password string) string {
+	if len(password) < MinPasswordLength {
+		return "Password too short"
+	}
+	if _, breached := BreachedPasswords[password]; breached {
+		return "This password is too common, it's been found in data breaches"
+	}
+	return ""
+}
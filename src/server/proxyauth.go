@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyAuthConfig trusts an authenticating reverse proxy to say who the user
+// is in a header, so they needn't log in to cascii too. Only requests coming
+// straight from one of the proxies are trusted, as anyone else could set the
+// header themselves.
+type ProxyAuthConfig struct {
+	Header  string
+	Proxies []*net.IPNet
+}
+
+// ProxyAuth is nil unless PROXY_AUTH_HEADER is set.
+var ProxyAuth *ProxyAuthConfig
+
+// LoadProxyAuth reads the header and the comma separated CIDRs of the proxies
+// to trust it from. There's no trusting the header without any CIDRs.
+func LoadProxyAuth(header string, cidrs string) (*ProxyAuthConfig, error) {
+	if header == "" {
+		return nil, nil
+	}
+	config := &ProxyAuthConfig{Header: header}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy CIDR %q: %w", cidr, err)
+		}
+		config.Proxies = append(config.Proxies, network)
+	}
+	if len(config.Proxies) == 0 {
+		return nil, errors.New("PROXY_AUTH_HEADER needs PROXY_AUTH_TRUSTED_CIDRS set too")
+	}
+	return config, nil
+}
+
+// UserEmail is the email the proxy says the request is from, if it came from
+// a trusted proxy.
+func (config *ProxyAuthConfig) UserEmail(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	trusted := false
+	for _, proxy := range config.Proxies {
+		trusted = trusted || proxy.Contains(ip)
+	}
+	email := strings.TrimSpace(r.Header.Get(config.Header))
+	if !trusted || !IsValidEmail(email) {
+		return "", false
+	}
+	return email, true
+}
+
+// GetOrCreateProxyUser finds the user with the email, creating them if need
+// be. The proxy has verified their email. Like logging in, it cancels their
+// account's deletion.
+func GetOrCreateProxyUser(db *sql.DB, email string) (int, error) {
+	// Every request comes this way, so most shouldn't need a transaction.
+	userId := -1
+	var deleting bool
+	err := db.QueryRow(
+		"SELECT id, delete_at IS NOT NULL FROM users WHERE email = ? AND verified_at IS NOT NULL", email,
+	).Scan(&userId, &deleting)
+	if err == nil && deleting {
+		_, err = CancelUserDeletion(db, userId)
+	}
+	if err != sql.ErrNoRows {
+		return userId, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	var verified bool
+	err = tx.QueryRow(
+		"SELECT id, verified_at IS NOT NULL FROM users WHERE email = ? FOR UPDATE", email,
+	).Scan(&userId, &verified)
+	if err != nil && err != sql.ErrNoRows {
+		return -1, err
+	}
+	if userId == -1 {
+		// Without a password, they can only get in through the proxy.
+		res, err := tx.Exec(
+			"INSERT INTO users (email, password, verified_at) VALUES (?, '', UTC_TIMESTAMP())", email,
+		)
+		if err != nil {
+			return -1, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return -1, err
+		}
+		userId = int(id)
+	} else if !verified {
+		if err := VerifyUserEmailOwner(tx, userId); err != nil {
+			return -1, err
+		}
+		if _, err := tx.Exec("UPDATE users SET delete_at = NULL WHERE id = ?", userId); err != nil {
+			return -1, err
+		}
+	}
+	return userId, tx.Commit()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+)
+
+const publishTokenLength = 22
+
+// PublishMutableDrawing issues a new public token for the user's drawing,
+// replacing any previous one. It returns an empty token if there is no such
+// drawing.
+func PublishMutableDrawing(db *sql.DB, drawingId int, userId int) (string, error) {
+	token := RandomBase62(publishTokenLength)
+	res, err := db.Exec(
+		`UPDATE mutable_drawings SET publish_token = ?, updated_at = updated_at
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		token,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return "", err
+	}
+	published, err := res.RowsAffected()
+	if err != nil || published == 0 {
+		return "", err
+	}
+	return token, nil
+}
+
+func UnpublishMutableDrawing(db *sql.DB, drawingId int, userId int) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE mutable_drawings SET publish_token = NULL, updated_at = updated_at
+		WHERE id = ? AND user_id = ? AND publish_token IS NOT NULL AND deleted_at IS NULL`,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	unpublished, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return unpublished == 1, nil
+}
+
+// GetPublishedMutableDrawing gets the latest saved version of the drawing
+// published under the token. Trashed drawings aren't served.
+func GetPublishedMutableDrawing(db *sql.DB, token string) (MutableDrawingRow, error) {
+	var row MutableDrawingRow
+	err := db.QueryRow(
+		`SELECT id, name, data, created_at, updated_at FROM mutable_drawings
+		WHERE publish_token = ? AND deleted_at IS NULL`,
+		token,
+	).Scan(&row.Id, &row.Name, &row.Data, &row.CreatedAt, &row.UpdatedAt)
+	if err == nil || err == sql.ErrNoRows {
+		return row, nil
+	}
+	return row, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const snippetRadius = 60
+
+type SearchResultRow struct {
+	Id          int
+	Name        string
+	CreatedAt   string
+	TextContent string
+	Score       float64
+}
+
+// ExtractDrawingText collects the text drawn in a drawing, i.e. every string
+// in its JSON. Strings of single characters, such as a row of cells, are
+// joined up so the words they spell can be found.
+func ExtractDrawingText(data string) string {
+	var decoded any
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+		return ""
+	}
+	var texts []string
+	var collect func(value any)
+	collect = func(value any) {
+		switch value := value.(type) {
+		case string:
+			texts = append(texts, value)
+		case map[string]any:
+			keys := slices.Sorted(maps.Keys(value))
+			for _, key := range keys {
+				collect(value[key])
+			}
+		case []any:
+			var run strings.Builder
+			for _, item := range value {
+				if char, ok := item.(string); ok && len([]rune(char)) == 1 {
+					run.WriteString(char)
+					continue
+				}
+				if run.Len() > 0 {
+					texts = append(texts, run.String())
+					run.Reset()
+				}
+				collect(item)
+			}
+			if run.Len() > 0 {
+				texts = append(texts, run.String())
+			}
+		}
+	}
+	collect(decoded)
+
+	var words []string
+	for _, text := range texts {
+		text = strings.TrimSpace(text)
+		if text != "" {
+			words = append(words, text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// SearchMutableDrawings ranks the user's drawings by how well their name and
+// text match the query.
+func SearchMutableDrawings(db *sql.DB, query string, userId int, limit int) ([]SearchResultRow, error) {
+	var results []SearchResultRow
+	rows, err := db.Query(
+		`SELECT id, name, created_at, IFNULL(text_content, ''),
+		MATCH (name, text_content) AGAINST (? IN NATURAL LANGUAGE MODE) AS score
+		FROM mutable_drawings
+		WHERE user_id = ? AND deleted_at IS NULL AND MATCH (name, text_content) AGAINST (? IN NATURAL LANGUAGE MODE)
+		ORDER BY score DESC, id DESC LIMIT ?`,
+		query,
+		userId,
+		query,
+		limit,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row SearchResultRow
+		if err := rows.Scan(&row.Id, &row.Name, &row.CreatedAt, &row.TextContent, &row.Score); err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func searchTermsPattern(query string) *regexp.Regexp {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		terms = append(terms, regexp.QuoteMeta(term))
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(terms, "|"))
+}
+
+// Highlight escapes the text for HTML and wraps each of the query's terms in a
+// <mark>. Long text is cut down to a snippet around the first match.
+func Highlight(text string, query string) string {
+	pattern := searchTermsPattern(query)
+	if pattern == nil {
+		return html.EscapeString(text)
+	}
+	runes := []rune(text)
+	if len(runes) > snippetRadius*2 {
+		start := 0
+		if match := pattern.FindStringIndex(text); match != nil {
+			start = max(len([]rune(text[:match[0]]))-snippetRadius, 0)
+		}
+		end := min(start+snippetRadius*2, len(runes))
+		snippet := string(runes[start:end])
+		if start > 0 {
+			snippet = "…" + snippet
+		}
+		if end < len(runes) {
+			snippet += "…"
+		}
+		text = snippet
+	}
+
+	var highlighted strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(text, -1) {
+		highlighted.WriteString(html.EscapeString(text[last:match[0]]))
+		highlighted.WriteString("<mark>" + html.EscapeString(text[match[0]:match[1]]) + "</mark>")
+		last = match[1]
+	}
+	highlighted.WriteString(html.EscapeString(text[last:]))
+	return highlighted.String()
+}
+
+// IndexMutableDrawingsText extracts the text of drawings saved before it was
+// extracted on every save, a batch at a time. It returns how many it did.
+func IndexMutableDrawingsText(db *sql.DB, batchSize int) (int, error) {
+	rows, err := db.Query(
+		"SELECT id, data FROM mutable_drawings WHERE text_content IS NULL LIMIT ?", batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	texts := map[int]string{}
+	for rows.Next() {
+		var id int
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		texts[id] = ExtractDrawingText(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, text := range texts {
+		if _, err := db.Exec(
+			// This isn't an edit, so shouldn't count as one.
+			"UPDATE mutable_drawings SET text_content = ?, updated_at = updated_at WHERE id = ?",
+			text,
+			id,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return len(texts), nil
+}
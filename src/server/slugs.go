@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}[a-z0-9]$`)
+
+// Slugs share the root path with the frontend's own routes.
+var reservedSlugs = map[string]bool{
+	"api":      true,
+	"static":   true,
+	"admin":    true,
+	"login":    true,
+	"logout":   true,
+	"signup":   true,
+	"user":     true,
+	"users":    true,
+	"drawings": true,
+	"help":     true,
+	"about":    true,
+	"settings": true,
+}
+
+type SlugRow struct {
+	ShortKey  string
+	CreatedAt string
+	UpdatedAt string
+}
+
+type SlugHistoryRow struct {
+	ShortKey   string
+	ReplacedAt string
+}
+
+func IsValidSlug(slug string) bool {
+	return slugPattern.MatchString(slug)
+}
+
+func IsReservedSlug(slug string) bool {
+	return reservedSlugs[slug]
+}
+
+// CreateSlug claims the slug for the user, returning false if it is taken.
+func CreateSlug(db *sql.DB, slug string, shortKey string, userId int) (bool, error) {
+	_, err := db.Exec(
+		"INSERT INTO slugs (slug, user_id, short_key) VALUES (?, ?, ?)",
+		slug,
+		userId,
+		shortKey,
+	)
+	if driverErr, ok := err.(*mysql.MySQLError); ok && driverErr.Number == mysqlerr.ER_DUP_ENTRY {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RepointSlug moves a slug owned by the user onto another short key, keeping
+// the one it replaces in the slug's history.
+func RepointSlug(db *sql.DB, slug string, shortKey string, userId int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var previousShortKey string
+	err = tx.QueryRow(
+		"SELECT short_key FROM slugs WHERE slug = ? AND user_id = ? FOR UPDATE", slug, userId,
+	).Scan(&previousShortKey)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if previousShortKey == shortKey {
+		return true, nil
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO slug_history (slug, short_key) VALUES (?, ?)", slug, previousShortKey,
+	); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(
+		"UPDATE slugs SET short_key = ? WHERE slug = ?", shortKey, slug,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func GetSlugShortKey(db *sql.DB, slug string) (string, error) {
+	var shortKey string
+	err := db.QueryRow("SELECT short_key FROM slugs WHERE slug = ?", slug).Scan(&shortKey)
+	if err == nil || err == sql.ErrNoRows {
+		return shortKey, nil
+	}
+	return shortKey, err
+}
+
+func GetSlug(db *sql.DB, slug string, userId int) (SlugRow, error) {
+	var row SlugRow
+	err := db.QueryRow(
+		"SELECT short_key, created_at, updated_at FROM slugs WHERE slug = ? AND user_id = ?",
+		slug,
+		userId,
+	).Scan(&row.ShortKey, &row.CreatedAt, &row.UpdatedAt)
+	if err == nil || err == sql.ErrNoRows {
+		return row, nil
+	}
+	return row, err
+}
+
+func ListSlugHistory(db *sql.DB, slug string) ([]SlugHistoryRow, error) {
+	var results []SlugHistoryRow
+	rows, err := db.Query(
+		"SELECT short_key, replaced_at FROM slug_history WHERE slug = ? ORDER BY id DESC",
+		slug,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row SlugHistoryRow
+		if err := rows.Scan(&row.ShortKey, &row.ReplacedAt); err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// ResolveImmutableDrawing finds a drawing by its short key, or failing that,
+// by a slug pointing at it. The resolved short key is returned with it.
+func ResolveImmutableDrawing(db *sql.DB, key string) (string, ImmutableDrawingRow, error) {
+	drawing, err := GetImmutableDrawing(db, key)
+	if err != nil || drawing.Data != "" {
+		return key, drawing, err
+	}
+	shortKey, err := GetSlugShortKey(db, key)
+	if err != nil || shortKey == "" {
+		return key, drawing, err
+	}
+	drawing, err = GetImmutableDrawing(db, shortKey)
+	return shortKey, drawing, err
+}
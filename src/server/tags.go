@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+type TagRow struct {
+	Name  string
+	Count int
+}
+
+// NormaliseTags lowercases and trims tags, dropping empty and repeated ones.
+func NormaliseTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalised := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalised = append(normalised, tag)
+		}
+	}
+	return normalised
+}
+
+// AddMutableDrawingTags tags the user's drawing, creating any of the user's
+// tags which don't exist yet. It returns false if there is no such drawing.
+func AddMutableDrawingTags(db *sql.DB, drawingId int, tags []string, userId int) (bool, error) {
+	tags = NormaliseTags(tags)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(
+		"SELECT 1 FROM mutable_drawings WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		drawingId,
+		userId,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = TagMutableDrawingTx(tx, drawingId, tags, userId); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// TagMutableDrawingTx tags a drawing, known to be the user's, as part of a
+// transaction. The tags must already be normalised.
+func TagMutableDrawingTx(tx *sql.Tx, drawingId int, tags []string, userId int) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(
+			"INSERT IGNORE INTO tags (user_id, name) VALUES (?, ?)", userId, tag,
+		); err != nil {
+			return err
+		}
+	}
+	args := []any{drawingId, userId}
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	_, err := tx.Exec(
+		`INSERT IGNORE INTO mutable_drawing_tags (drawing_id, tag_id)
+		SELECT ?, id FROM tags WHERE user_id = ? AND name IN (`+SqlPlaceholders(len(tags))+`)`,
+		args...,
+	)
+	return err
+}
+
+// RemoveMutableDrawingTag untags the user's drawing, and deletes the tag once
+// nothing is tagged with it.
+func RemoveMutableDrawingTag(db *sql.DB, drawingId int, tag string, userId int) (bool, error) {
+	res, err := db.Exec(
+		`DELETE mutable_drawing_tags FROM mutable_drawing_tags
+		JOIN tags ON tags.id = mutable_drawing_tags.tag_id
+		JOIN mutable_drawings ON mutable_drawings.id = mutable_drawing_tags.drawing_id
+		WHERE mutable_drawings.id = ? AND mutable_drawings.user_id = ? AND tags.name = ?`,
+		drawingId,
+		userId,
+		strings.ToLower(strings.TrimSpace(tag)),
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	_, err = db.Exec(
+		`DELETE FROM tags WHERE user_id = ?
+		AND NOT EXISTS (SELECT 1 FROM mutable_drawing_tags WHERE tag_id = tags.id)`,
+		userId,
+	)
+	return deleted == 1, err
+}
+
+func GetMutableDrawingTags(db *sql.DB, drawingId int) ([]string, error) {
+	tags := []string{}
+	rows, err := db.Query(
+		`SELECT tags.name FROM tags
+		JOIN mutable_drawing_tags ON mutable_drawing_tags.tag_id = tags.id
+		WHERE mutable_drawing_tags.drawing_id = ? ORDER BY tags.name`,
+		drawingId,
+	)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return tags, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetUserDrawingTags maps each of the user's tagged drawings to its tags.
+func GetUserDrawingTags(db *sql.DB, userId int) (map[int][]string, error) {
+	tags := map[int][]string{}
+	rows, err := db.Query(
+		`SELECT mutable_drawing_tags.drawing_id, tags.name FROM tags
+		JOIN mutable_drawing_tags ON mutable_drawing_tags.tag_id = tags.id
+		WHERE tags.user_id = ? ORDER BY tags.name`,
+		userId,
+	)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var drawingId int
+		var tag string
+		if err := rows.Scan(&drawingId, &tag); err != nil {
+			return tags, err
+		}
+		tags[drawingId] = append(tags[drawingId], tag)
+	}
+	return tags, rows.Err()
+}
+
+func ListTags(db *sql.DB, userId int) ([]TagRow, error) {
+	var results []TagRow
+	rows, err := db.Query(
+		`SELECT tags.name, COUNT(mutable_drawings.id) FROM tags
+		LEFT JOIN mutable_drawing_tags ON mutable_drawing_tags.tag_id = tags.id
+		LEFT JOIN mutable_drawings ON mutable_drawings.id = mutable_drawing_tags.drawing_id
+		AND mutable_drawings.deleted_at IS NULL
+		WHERE tags.user_id = ? GROUP BY tags.id ORDER BY tags.name`,
+		userId,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row TagRow
+		if err := rows.Scan(&row.Name, &row.Count); err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
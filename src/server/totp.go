@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP codes as per RFC 6238, with the parameters every authenticator app
+// supports: SHA-1, 6 digits and 30 second steps.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many steps either side of now are accepted, to allow for
+	// clock drift and slow typing.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// After MaxTotpFailures wrong codes in a row, codes aren't checked until
+	// totpLockout has passed since the last one.
+	MaxTotpFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TotpState struct {
+	Secret  sql.NullString
+	Enabled bool
+}
+
+func GenerateTotpSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TotpCode is the code for the secret at the time step.
+func TotpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+func TotpStep(at time.Time) int64 {
+	return at.Unix() / totpPeriod
+}
+
+// MatchTotpCode finds the time step, near enough to now, that the code is for.
+func MatchTotpCode(secret string, code string, now time.Time) (int64, bool) {
+	current := TotpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(TotpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TotpUri is what authenticator apps scan, usually as a QR code, to add the
+// account.
+func TotpUri(email string, secret string) string {
+	label := url.PathEscape("cascii:" + email)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {"cascii"},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func GetTotpState(db *sql.DB, userId int) (TotpState, error) {
+	var state TotpState
+	err := db.QueryRow(
+		"SELECT totp_secret, totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userId,
+	).Scan(&state.Secret, &state.Enabled)
+	if err == nil || err == sql.ErrNoRows {
+		return state, nil
+	}
+	return state, err
+}
+
+// BeginTotpEnrollment gives the user a new secret, which isn't used until a
+// code for it is confirmed. Starting over replaces it.
+func BeginTotpEnrollment(db *sql.DB, userId int) (string, error) {
+	secret := GenerateTotpSecret()
+	_, err := db.Exec(
+		"UPDATE users SET totp_secret = ? WHERE id = ? AND totp_enabled_at IS NULL",
+		secret,
+		userId,
+	)
+	return secret, err
+}
+
+// ConfirmTotpEnrollment turns on 2FA for the user if the code is right for
+// their new secret, returning their recovery codes. None are returned if the
+// code is wrong.
+func ConfirmTotpEnrollment(db *sql.DB, userId int, code string) ([]string, error) {
+	state, err := GetTotpState(db, userId)
+	if err != nil || state.Enabled || !state.Secret.Valid {
+		return nil, err
+	}
+	if _, ok := MatchTotpCode(state.Secret.String, code, time.Now()); !ok {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`UPDATE users SET totp_enabled_at = UTC_TIMESTAMP(), totp_last_step = NULL,
+		totp_failures = 0 WHERE id = ? AND totp_secret = ? AND totp_enabled_at IS NULL`,
+		userId,
+		state.Secret.String,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if enabled, err := res.RowsAffected(); err != nil || enabled == 0 {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// replaceRecoveryCodes issues the user a new set of single use recovery codes,
+// for when they lose their authenticator. Only hashes of them are stored.
+func replaceRecoveryCodes(tx *sql.Tx, userId int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId); err != nil {
+		return nil, err
+	}
+	var codes []string
+	for range recoveryCodeCount {
+		code := strings.ToLower(RandomBase62(5) + "-" + RandomBase62(5))
+		if _, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userId, Hash(code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func DisableTotp(db *sql.DB, userId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(
+		`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL,
+		totp_failures = 0, totp_failed_at = NULL WHERE id = ?`,
+		userId,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CheckTotpCode checks a code from the user's authenticator, or one of their
+// recovery codes, using it up. Each code is accepted only once. After too many
+// wrong codes the user is locked out for a while, in which case the second
+// result is true and no code is accepted.
+func CheckTotpCode(db *sql.DB, userId int, code string) (bool, bool, error) {
+	var secret string
+	var locked bool
+	err := db.QueryRow(
+		`SELECT totp_secret, totp_failures >= ?
+		AND totp_failed_at > UTC_TIMESTAMP() - INTERVAL ? SECOND
+		FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL`,
+		MaxTotpFailures,
+		int(totpLockout.Seconds()),
+		userId,
+	).Scan(&secret, &locked)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil || locked {
+		return false, locked, err
+	}
+
+	code = strings.ToLower(strings.ReplaceAll(code, " ", ""))
+	if step, matched := MatchTotpCode(secret, code, time.Now()); matched {
+		res, err := db.Exec(
+			`UPDATE users SET totp_last_step = ?, totp_failures = 0
+			WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`,
+			step,
+			userId,
+			step,
+		)
+		if err != nil {
+			return false, false, err
+		}
+		accepted, err := res.RowsAffected()
+		if err != nil || accepted == 1 {
+			return accepted == 1, false, err
+		}
+	} else {
+		res, err := db.Exec(
+			`UPDATE recovery_codes SET used_at = UTC_TIMESTAMP()
+			WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+			userId,
+			Hash(code),
+		)
+		if err != nil {
+			return false, false, err
+		}
+		used, err := res.RowsAffected()
+		if err != nil {
+			return false, false, err
+		}
+		if used == 1 {
+			_, err := db.Exec("UPDATE users SET totp_failures = 0 WHERE id = ?", userId)
+			return err == nil, false, err
+		}
+	}
+
+	// A failure after the lockout has passed starts the count again.
+	_, err = db.Exec(
+		`UPDATE users SET totp_failed_at = UTC_TIMESTAMP(),
+		totp_failures = IF(totp_failures >= ?, 1, totp_failures + 1) WHERE id = ?`,
+		MaxTotpFailures,
+		userId,
+	)
+	return false, false, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// TrashRetentionDays is how long a deleted drawing stays in the trash before
+// it is purged for good.
+var TrashRetentionDays = GetEnvInt("TRASH_RETENTION_DAYS", 30)
+
+type TrashedMutableDrawingRow struct {
+	Id        int
+	Name      string
+	CreatedAt string
+	DeletedAt string
+	PurgeAt   string
+}
+
+func ListTrashedMutableDrawings(db *sql.DB, userId int) ([]TrashedMutableDrawingRow, error) {
+	var results []TrashedMutableDrawingRow
+	rows, err := db.Query(
+		`SELECT id, name, created_at, deleted_at, DATE_ADD(deleted_at, INTERVAL ? DAY)
+		FROM mutable_drawings WHERE user_id = ? AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id DESC`,
+		TrashRetentionDays,
+		userId,
+	)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row TrashedMutableDrawingRow
+		err := rows.Scan(&row.Id, &row.Name, &row.CreatedAt, &row.DeletedAt, &row.PurgeAt)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func RestoreMutableDrawing(db *sql.DB, drawingId int, userId int) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE mutable_drawings SET deleted_at = NULL, updated_at = updated_at
+		WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL`,
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	restored, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return restored == 1, nil
+}
+
+// PurgeMutableDrawing permanently deletes a drawing, which must already be in
+// the trash.
+func PurgeMutableDrawing(db *sql.DB, drawingId int, userId int) (bool, error) {
+	res, err := db.Exec(
+		"DELETE FROM mutable_drawings WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL",
+		drawingId,
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
+
+func PurgeExpiredTrash(db *sql.DB) (int64, error) {
+	res, err := db.Exec(
+		"DELETE FROM mutable_drawings WHERE deleted_at <= UTC_TIMESTAMP() - INTERVAL ? DAY",
+		TrashRetentionDays,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
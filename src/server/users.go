@@ -1,31 +1,62 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
-
-	"golang.org/x/crypto/bcrypt"
+	"encoding/hex"
+	"time"
 )
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	return string(bytes), err
-}
+// AccountDeletionGraceDays is how long after asking for their account to be
+// deleted a user can still change their mind, by logging back in.
+var AccountDeletionGraceDays = GetEnvInt("ACCOUNT_DELETION_GRACE_DAYS", 14)
+
+// RequireVerifiedEmail stops users logging in until they've verified their
+// email. Otherwise they can use their account straight away.
+var RequireVerifiedEmail = GetEnv("REQUIRE_VERIFIED_EMAIL", "false") == "true"
+
+// SessionRotationMinutes is how often a session gets a new key as it's used,
+// so a stolen cookie soon stops working.
+var SessionRotationMinutes = GetEnvInt("SESSION_ROTATION_MINUTES", 24*60)
+
+// SessionRotationGrace is how long a session's previous key still works for,
+// for requests that were already on their way with it.
+const SessionRotationGrace = time.Minute
+
+// MailResendInterval is the least time between mails of one kind to the same
+// address, so they can't be used to flood someone's inbox.
+var MailResendInterval = time.Minute
+
+// ReauthenticationMinutes is how recently users without a password must have
+// logged in, to do what others need their password for.
+var ReauthenticationMinutes = GetEnvInt("REAUTHENTICATION_MINUTES", 10)
 
 func MakeSessionKey() string {
 	return GenerateUUID()
 }
 
-func CreateUser(db *sql.DB, email string, password string) error {
+// HashSessionKey is what sessions are stored by, so the keys themselves are
+// only ever in users' cookies.
+func HashSessionKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func CreateUser(db *sql.DB, email string, password string) (int, error) {
 	password, err := HashPassword(password)
 	if err != nil {
-		return err
+		return -1, err
 	}
-	_, err = db.Exec(
+	res, err := db.Exec(
 		"INSERT INTO users (email, password) VALUES (?, ?)",
 		email,
 		password,
 	)
-	return err
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
 }
 
 func GetUserById(db *sql.DB, id int) (string, error) {
@@ -37,6 +68,97 @@ func GetUserById(db *sql.DB, id int) (string, error) {
 	return email, err
 }
 
+func IsUserVerified(db *sql.DB, userId int) (bool, error) {
+	var verified bool
+	err := db.QueryRow(
+		"SELECT verified_at IS NOT NULL FROM users WHERE id = ?", userId,
+	).Scan(&verified)
+	if err == nil || err == sql.ErrNoRows {
+		return verified, nil
+	}
+	return verified, err
+}
+
+// VerifyUserEmail marks the user verified, as long as the email is still
+// theirs. Verifying twice is fine.
+func VerifyUserEmail(db *sql.DB, userId int, email string) (bool, error) {
+	if _, err := db.Exec(
+		"UPDATE users SET verified_at = UTC_TIMESTAMP() WHERE id = ? AND email = ? AND verified_at IS NULL",
+		userId,
+		email,
+	); err != nil {
+		return false, err
+	}
+	var verified bool
+	err := db.QueryRow(
+		"SELECT verified_at IS NOT NULL FROM users WHERE id = ? AND email = ?", userId, email,
+	).Scan(&verified)
+	if err == nil || err == sql.ErrNoRows {
+		return verified, nil
+	}
+	return verified, err
+}
+
+// VerifyUserEmailOwner marks the user verified for someone who's just shown
+// the email is theirs some other way than a password. If it wasn't verified
+// before, whoever signed up with it may not have been them, so the password
+// chosen then stops working and anyone logged in with it is logged out.
+func VerifyUserEmailOwner(tx *sql.Tx, userId int) error {
+	res, err := tx.Exec(
+		"UPDATE users SET verified_at = UTC_TIMESTAMP(), password = '' WHERE id = ? AND verified_at IS NULL",
+		userId,
+	)
+	if err != nil {
+		return err
+	}
+	verified, err := res.RowsAffected()
+	if err != nil || verified == 0 {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+	return err
+}
+
+// ClaimVerificationMail notes that a verification mail is being sent to the
+// unverified user, unless one was sent within MailResendInterval, in which
+// case it's false and none should be.
+func ClaimVerificationMail(db *sql.DB, userId int) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE users SET verification_sent_at = UTC_TIMESTAMP()
+		WHERE id = ? AND verified_at IS NULL
+		AND (verification_sent_at IS NULL OR verification_sent_at <= UTC_TIMESTAMP() - INTERVAL ? SECOND)`,
+		userId,
+		MailResendInterval.Seconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	return claimed == 1, err
+}
+
+func GetUserIdByEmail(db *sql.DB, email string) (int, error) {
+	userId := -1
+	err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userId)
+	if err == nil || err == sql.ErrNoRows {
+		return userId, nil
+	}
+	return userId, err
+}
+
+// GetUnverifiedUserId finds the user with the email, if they're yet to verify
+// it. Otherwise it returns -1.
+func GetUnverifiedUserId(db *sql.DB, email string) (int, error) {
+	userId := -1
+	err := db.QueryRow(
+		"SELECT id FROM users WHERE email = ? AND verified_at IS NULL", email,
+	).Scan(&userId)
+	if err == nil || err == sql.ErrNoRows {
+		return userId, nil
+	}
+	return userId, err
+}
+
 func UserExists(db *sql.DB, email string) (bool, error) {
 	var exists bool
 	err := db.QueryRow("SELECT 1 FROM users WHERE email = ?", email).Scan(&exists)
@@ -59,18 +181,226 @@ func Authenticate(db *sql.DB, email string, password string) (int, error) {
 		}
 		return -1, err
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err != nil {
+	if !CheckPassword(hash, password) {
 		return -1, nil
 	}
+	// Now's the only time the password is known, to hash it the preferred way.
+	if PasswordNeedsRehash(hash) {
+		newHash, err := HashPassword(password)
+		if err != nil {
+			return -1, err
+		}
+		// Unless it's been changed in the meantime.
+		_, err = db.Exec(
+			"UPDATE users SET password = ? WHERE id = ? AND password = ?", newHash, userId, hash,
+		)
+		if err != nil {
+			return -1, err
+		}
+	}
 	return userId, nil
 }
 
+func CheckUserPassword(db *sql.DB, userId int, password string) (bool, error) {
+	var hash string
+	err := db.QueryRow("SELECT password FROM users WHERE id = ?", userId).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return CheckPassword(hash, password), nil
+}
+
+// HasPassword is false for users who've only ever logged in some other way,
+// such as with an OIDC provider.
+func HasPassword(db *sql.DB, userId int) (bool, error) {
+	var hasPassword bool
+	err := db.QueryRow("SELECT password != '' FROM users WHERE id = ?", userId).Scan(&hasPassword)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return hasPassword, err
+}
+
+func SetUserPassword(db *sql.DB, userId int, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userId)
+	return err
+}
+
+// SetPendingEmail holds the email the user wants to change to, until they
+// prove it's theirs. Only the latest one asked for can be confirmed.
+func SetPendingEmail(db *sql.DB, userId int, email string) error {
+	_, err := db.Exec("UPDATE users SET pending_email = ? WHERE id = ?", email, userId)
+	return err
+}
+
+// ConfirmEmailChange switches the user to their pending email, as long as it
+// is the one given and no one else has taken it since. The link confirming it
+// was sent to the email, so it's verified too.
+func ConfirmEmailChange(db *sql.DB, userId int, email string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow("SELECT 1 FROM users WHERE email = ? FOR UPDATE", email).Scan(&taken)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if taken {
+		return false, nil
+	}
+	res, err := tx.Exec(
+		`UPDATE users SET email = pending_email, pending_email = NULL,
+		verified_at = UTC_TIMESTAMP() WHERE id = ? AND pending_email = ?`,
+		userId,
+		email,
+	)
+	if err != nil {
+		return false, err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil || changed == 0 {
+		return false, err
+	}
+	// Login links sent to the old email shouldn't outlive it.
+	if _, err := tx.Exec("DELETE FROM login_links WHERE user_id = ?", userId); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ScheduleUserDeletion marks the user to be deleted once the grace period is
+// over, returning when that is.
+func ScheduleUserDeletion(db *sql.DB, userId int) (string, error) {
+	var deleteAt string
+	if _, err := db.Exec(
+		"UPDATE users SET delete_at = UTC_TIMESTAMP() + INTERVAL ? DAY WHERE id = ?",
+		AccountDeletionGraceDays,
+		userId,
+	); err != nil {
+		return deleteAt, err
+	}
+	err := db.QueryRow("SELECT delete_at FROM users WHERE id = ?", userId).Scan(&deleteAt)
+	return deleteAt, err
+}
+
+func CancelUserDeletion(db *sql.DB, userId int) (bool, error) {
+	res, err := db.Exec(
+		"UPDATE users SET delete_at = NULL WHERE id = ? AND delete_at IS NOT NULL", userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	cancelled, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return cancelled == 1, nil
+}
+
+// DeleteUser deletes the user and everything they own. Short links themselves
+// aren't owned by anyone, but the slugs claimed for them are.
+func DeleteUser(db *sql.DB, userId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exportFiles []sql.NullString
+	rows, err := tx.Query("SELECT file_name FROM data_exports WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var fileName sql.NullString
+		if err := rows.Scan(&fileName); err != nil {
+			rows.Close()
+			return err
+		}
+		exportFiles = append(exportFiles, fileName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Ordered so that rows are deleted before those they reference. Drawings
+	// take their tags, history and edit links with them.
+	statements := []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		`DELETE slug_history FROM slug_history
+		JOIN slugs ON slugs.slug = slug_history.slug WHERE slugs.user_id = ?`,
+		"DELETE FROM slugs WHERE user_id = ?",
+		"DELETE FROM mutable_drawings WHERE user_id = ?",
+		"DELETE FROM tags WHERE user_id = ?",
+		"UPDATE folders SET parent_id = NULL WHERE user_id = ?",
+		"DELETE FROM folders WHERE user_id = ?",
+		"DELETE FROM data_exports WHERE user_id = ?",
+		// Those they invited stay, just no longer traced back to them.
+		"UPDATE users SET invite_id = NULL WHERE invite_id IN (SELECT id FROM invites WHERE user_id = ?)",
+		"DELETE FROM invites WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userId); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, fileName := range exportFiles {
+		if err := RemoveDataExportFile(fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeDeletedUsers deletes the users whose grace period is over. It returns
+// how many were deleted.
+func PurgeDeletedUsers(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT id FROM users WHERE delete_at <= UTC_TIMESTAMP()")
+	if err != nil {
+		return 0, err
+	}
+	var userIds []int
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for i, userId := range userIds {
+		if err := DeleteUser(db, userId); err != nil {
+			return i, err
+		}
+	}
+	return len(userIds), nil
+}
+
 func CreateSession(db *sql.DB, userId int) (string, error) {
 	key := MakeSessionKey()
 	_, err := db.Exec(
-		"INSERT INTO sessions (session_key, user_id) VALUES (?, ?)",
-		key,
+		`INSERT INTO sessions (key_hash, user_id, rotated_at, authenticated_at)
+		VALUES (?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())`,
+		HashSessionKey(key),
 		userId,
 	)
 	if err == nil {
@@ -84,11 +414,90 @@ func DeleteSession(db *sql.DB, userId int) error {
 	return err
 }
 
+// DeleteOtherSessions logs the user out everywhere but the given session.
+func DeleteOtherSessions(db *sql.DB, userId int, keepKey string) error {
+	_, err := db.Exec(
+		"DELETE FROM sessions WHERE user_id = ? AND key_hash != ?", userId, HashSessionKey(keepKey),
+	)
+	return err
+}
+
 func GetSessionUserId(db *sql.DB, key string) (int, error) {
 	userId := -1
-	err := db.QueryRow("SELECT user_id FROM sessions WHERE session_key = ?", key).Scan(&userId)
+	keyHash := HashSessionKey(key)
+	err := db.QueryRow(
+		`SELECT user_id FROM sessions WHERE key_hash = ?
+		OR (previous_key_hash = ? AND rotated_at > UTC_TIMESTAMP() - INTERVAL ? SECOND)`,
+		keyHash,
+		keyHash,
+		SessionRotationGrace.Seconds(),
+	).Scan(&userId)
 	if err == nil || err == sql.ErrNoRows {
 		return userId, nil
 	}
 	return userId, err
 }
+
+// IsSessionRecent tells whether the session was logged into within the last
+// ReauthenticationMinutes. Rotating its key doesn't count.
+func IsSessionRecent(db *sql.DB, key string) (bool, error) {
+	var recent bool
+	keyHash := HashSessionKey(key)
+	err := db.QueryRow(
+		`SELECT authenticated_at > UTC_TIMESTAMP() - INTERVAL ? MINUTE FROM sessions
+		WHERE key_hash = ?
+		OR (previous_key_hash = ? AND rotated_at > UTC_TIMESTAMP() - INTERVAL ? SECOND)`,
+		ReauthenticationMinutes,
+		keyHash,
+		keyHash,
+		SessionRotationGrace.Seconds(),
+	).Scan(&recent)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return recent, err
+}
+
+// RotateSession gives the session a new key, returning it, or "" if there's
+// no such session. The old key stops working straight away, as is wanted
+// when what the session can do changes.
+func RotateSession(db *sql.DB, key string) (string, error) {
+	newKey := MakeSessionKey()
+	res, err := db.Exec(
+		`UPDATE sessions SET key_hash = ?, previous_key_hash = NULL, rotated_at = UTC_TIMESTAMP()
+		WHERE key_hash = ?`,
+		HashSessionKey(newKey),
+		HashSessionKey(key),
+	)
+	if err != nil {
+		return "", err
+	}
+	rotated, err := res.RowsAffected()
+	if err != nil || rotated == 0 {
+		return "", err
+	}
+	return newKey, nil
+}
+
+// RefreshSession gives the session a new key if it's had its current one for
+// SessionRotationMinutes, returning it, or "" if it isn't due. The old key
+// keeps working for SessionRotationGrace.
+func RefreshSession(db *sql.DB, key string) (string, error) {
+	newKey := MakeSessionKey()
+	// MySQL assigns in order, so the previous key is set before it's replaced.
+	res, err := db.Exec(
+		`UPDATE sessions SET previous_key_hash = key_hash, key_hash = ?, rotated_at = UTC_TIMESTAMP()
+		WHERE key_hash = ? AND rotated_at <= UTC_TIMESTAMP() - INTERVAL ? MINUTE`,
+		HashSessionKey(newKey),
+		HashSessionKey(key),
+		SessionRotationMinutes,
+	)
+	if err != nil {
+		return "", err
+	}
+	rotated, err := res.RowsAffected()
+	if err != nil || rotated == 0 {
+		return "", err
+	}
+	return newKey, nil
+}
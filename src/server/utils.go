@@ -1,12 +1,55 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var secretKey = loadSecretKey()
+
+func loadSecretKey() []byte {
+	if key := os.Getenv("SECRET_KEY"); key != "" {
+		return []byte(key)
+	}
+	// Anything signed with this won't survive a restart, which is tolerable
+	// locally but not in prod.
+	log.Print("SECRET_KEY is not set, using a random one")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func GetEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func GetEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("%s is not a number, using %d", name, fallback)
+		return fallback
+	}
+	return parsed
+}
+
 func Hash(str string) string {
 	hash := sha512.New()
 	hash.Write([]byte(str))
@@ -16,3 +59,43 @@ func Hash(str string) string {
 func GenerateUUID() string {
 	return uuid.New().String()
 }
+
+func Sign(value string) string {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(value string, signature string) bool {
+	return hmac.Equal([]byte(Sign(value)), []byte(signature))
+}
+
+// MakeSignedToken makes a token carrying the value until it expires. The
+// purpose is signed too, so a token made for one purpose is no good for any
+// other.
+func MakeSignedToken(purpose string, value string, expires time.Time) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	return encoded + "." + expiresUnix + "." + Sign(purpose+"."+encoded+"."+expiresUnix)
+}
+
+// ParseSignedToken returns the value of a token made for the purpose, as long
+// as it is genuine and hasn't expired.
+func ParseSignedToken(purpose string, token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	if !VerifySignature(purpose+"."+parts[0]+"."+parts[1], parts[2]) {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
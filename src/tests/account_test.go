@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangePassword_successful(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test@test.com")
+	resp1 := PostWithClient(
+		client1,
+		USER_API+"password",
+		ChangePasswordRequest{CurrentPassword: "12345", NewPassword: "123456"},
+		&GenericResponse{},
+	)
+	resp2 := GetWithClient(client1, USER_API, &UserResponse{})
+	resp3 := GetWithClient(client2, USER_API, &GenericResponse{})
+	var respBody GenericResponse
+	PostWithClient(
+		MakeCookieClient(),
+		USER_API+"auth",
+		AuthUserRequest{Email: "test@test.com", Password: "123456"},
+		&respBody,
+	)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp3.StatusCode)
+	assert.Empty(t, respBody.Error)
+}
+
+func TestChangePassword_incorrectPassword(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody GenericResponse
+	resp := PostWithClient(
+		client,
+		USER_API+"password",
+		ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "123456"},
+		&respBody,
+	)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Incorrect password", respBody.Error)
+}
+
+func TestChangeEmail_verified(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	resp1 := PostWithClient(
+		client,
+		USER_API+"email",
+		ChangeEmailRequest{Email: "new@test.com", Password: "12345"},
+		&GenericResponse{},
+	)
+	var respBody1 UserResponse
+	GetWithClient(client, USER_API, &respBody1)
+	resp2 := Get(ReadLatestMailLink("new@test.com"), &GenericResponse{})
+	var respBody2 UserResponse
+	GetWithClient(client, USER_API, &respBody2)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, "test@test.com", respBody1.Email)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "new@test.com", respBody2.Email)
+}
+
+func TestChangeEmail_taken(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	LoginUser("test1@test.com")
+	var respBody GenericResponse
+	PostWithClient(
+		client,
+		USER_API+"email",
+		ChangeEmailRequest{Email: "test1@test.com", Password: "12345"},
+		&respBody,
+	)
+	assert.Equal(t, "User already exists", respBody.Error)
+}
+
+func TestChangeEmail_badToken(t *testing.T) {
+	clearDb()
+	resp := Get(USER_API+"email/verify?token=nothing", &GenericResponse{})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestDeleteUser_loginCancels(t *testing.T) {
+	clearDb()
+	userId, client := LoginUser("test@test.com")
+	var respBody DeleteUserResponse
+	resp1 := DeleteWithClientAndBody(client, USER_API, DeleteUserRequest{Password: "12345"}, &respBody)
+	resp2 := GetWithClient(client, USER_API, &GenericResponse{})
+	var deleteAt1 sql.NullString
+	db.QueryRow("SELECT delete_at FROM users WHERE id = ?", userId).Scan(&deleteAt1)
+	LoginUser("test@test.com")
+	var deleteAt2 sql.NullString
+	db.QueryRow("SELECT delete_at FROM users WHERE id = ?", userId).Scan(&deleteAt2)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.NotEmpty(t, respBody.DeleteAt)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.True(t, deleteAt1.Valid)
+	assert.False(t, deleteAt2.Valid)
+}
+
+func TestDeleteUser_purged(t *testing.T) {
+	clearDb()
+	userId, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	TagTestMutableDrawing(client, drawingId, "draft")
+	CreateTestFolder(client, "payments", 0)
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	DeleteWithClientAndBody(client, USER_API, DeleteUserRequest{Password: "12345"}, &DeleteUserResponse{})
+	db.Exec("UPDATE users SET delete_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	purged, err := PurgeDeletedUsers(db)
+	var users, drawings, slugs int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userId).Scan(&users)
+	db.QueryRow("SELECT COUNT(*) FROM mutable_drawings").Scan(&drawings)
+	db.QueryRow("SELECT COUNT(*) FROM slugs").Scan(&slugs)
+	// Short links have no owner, as anyone can make them, so only the slug
+	// pointing at one goes with the user.
+	resp1 := Get(DRAWINGS_API+"immutable/"+shortKey, &GetImmutableDrawingResponse{})
+	resp2 := Get(DRAWINGS_API+"immutable/payments-flow", &GenericResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, 0, users)
+	assert.Equal(t, 0, drawings)
+	assert.Equal(t, 0, slugs)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataExport_successful(t *testing.T) {
+	clearDb()
+	userId, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "ledger service")
+	DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GenericResponse{})
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	Get(DRAWINGS_API+"immutable/payments-flow", &GetImmutableDrawingResponse{})
+
+	var createBody, pendingBody, readyBody DataExportResponse
+	resp1 := PostWithClient(client, USER_API+"data-export", nil, &createBody)
+	GetWithClient(client, USER_API+fmt.Sprintf("data-export/%d", createBody.Id), &pendingBody)
+	_, err := RunDataExports(db)
+	resp2 := GetWithClient(client, USER_API+fmt.Sprintf("data-export/%d", createBody.Id), &readyBody)
+	link := ReadLatestMailLink("test@test.com")
+	resp3, archive := GetTestExport(client, link)
+
+	var data PersonalData
+	var manifest ExportManifest
+	json.Unmarshal([]byte(ReadTestExportFile(archive, "data.json")), &data)
+	json.Unmarshal([]byte(ReadTestExportFile(archive, "manifest.json")), &manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, "pending", pendingBody.Status)
+	assert.Empty(t, pendingBody.DownloadUrl)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "ready", readyBody.Status)
+	assert.NotEmpty(t, readyBody.ExpiresAt)
+	assert.Equal(t, fmt.Sprintf("/api/user/data-export/%d/download", createBody.Id), readyBody.DownloadUrl)
+	assert.Equal(t, http.StatusOK, resp3.StatusCode)
+	assert.Equal(t, userId, data.User.Id)
+	assert.Equal(t, "test@test.com", data.User.Email)
+	assert.NotEmpty(t, data.User.CreatedAt)
+	assert.Len(t, data.Sessions, 1)
+	assert.NotEmpty(t, data.Sessions[0].AuthenticatedAt)
+	assert.NotEmpty(t, data.Sessions[0].RotatedAt)
+	assert.Len(t, data.Slugs, 1)
+	assert.Equal(t, shortKey, data.Slugs[0].ShortKey)
+	assert.Equal(t, 1, data.Slugs[0].Hits)
+	assert.Len(t, manifest.Drawings, 1)
+	assert.NotEmpty(t, manifest.Drawings[0].DeletedAt)
+}
+
+func TestDataExport_otherUser(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test1@test.com")
+	_, client2 := LoginUser("test2@test.com")
+	var createBody DataExportResponse
+	PostWithClient(client1, USER_API+"data-export", nil, &createBody)
+	RunDataExports(db)
+	resp1 := GetWithClient(client2, USER_API+fmt.Sprintf("data-export/%d", createBody.Id), &GenericResponse{})
+	resp2 := GetWithClient(
+		client2, USER_API+fmt.Sprintf("data-export/%d/download", createBody.Id), &GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+}
+
+func TestDataExport_expired(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var createBody DataExportResponse
+	PostWithClient(client, USER_API+"data-export", nil, &createBody)
+	RunDataExports(db)
+	db.Exec("UPDATE data_exports SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	purged, err := PurgeExpiredDataExports(db)
+	resp := GetWithClient(client, USER_API+fmt.Sprintf("data-export/%d", createBody.Id), &GenericResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetPersonalData_invites(t *testing.T) {
+	clearDb()
+	inviterId, _ := LoginUser("inviter@test.com")
+	_, code1, _ := CreateInvite(db, inviterId, nil, nil)
+	userId, _ := CreateInvitedUser(db, "test@test.com", "12345", code1)
+	db.Exec("UPDATE users SET verified_at = UTC_TIMESTAMP() WHERE id = ?", userId)
+	inviteId, code2, _ := CreateInvite(db, userId, nil, nil)
+	CreateInvitedUser(db, "invitee@test.com", "12345", code2)
+
+	data, err := GetPersonalData(db, userId)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, data.User.VerifiedAt)
+	assert.NotZero(t, data.User.InviteId)
+	assert.Equal(t, "inviter@test.com", data.User.InvitedBy)
+	assert.Len(t, data.Invites, 1)
+	assert.Equal(t, inviteId, data.Invites[0].Id)
+	assert.Equal(t, 1, data.Invites[0].Uses)
+	assert.Equal(t, []string{"invitee@test.com"}, data.Invites[0].Invitees)
+}
+
+func TestClaimDataExport_staleByStartTime(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var createBody DataExportResponse
+	PostWithClient(client, USER_API+"data-export", nil, &createBody)
+	// Queued long ago, but only just claimed.
+	db.Exec("UPDATE data_exports SET created_at = UTC_TIMESTAMP() - INTERVAL 2 HOUR")
+	row1, err1 := ClaimDataExport(db)
+	row2, err2 := ClaimDataExport(db)
+	db.Exec("UPDATE data_exports SET started_at = UTC_TIMESTAMP() - INTERVAL 2 HOUR")
+	row3, err3 := ClaimDataExport(db)
+
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Nil(t, err3)
+	assert.Equal(t, createBody.Id, row1.Id)
+	assert.Equal(t, 0, row2.Id)
+	assert.Equal(t, createBody.Id, row3.Id)
+}
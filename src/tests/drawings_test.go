@@ -23,7 +23,7 @@ func TestCreateImmutableDrawing_succesful(t *testing.T) {
 		&respBody,
 	)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "c59e4", respBody.ShortKey)
+	assert.Equal(t, "JSK6S", respBody.ShortKey)
 }
 
 func TestCreateImmutableDrawing_duplicate(t *testing.T) {
@@ -40,54 +40,93 @@ func TestCreateImmutableDrawing_duplicate(t *testing.T) {
 		&respBody,
 	)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "c59e4", respBody.ShortKey)
+	assert.Equal(t, "JSK6S", respBody.ShortKey)
 }
 
 func TestCreateImmutableDrawing_realConflict(t *testing.T) {
 	/*
 		The following function can be used to find two different
 		values which have the same x first characters in their
-		respective Hash output.
+		respective base62 encoded Hash output.
 
 		func main() {
 			template1 := "{\"test\": \"%d\"}"
 			template2 := "{\"%d\": \"test\"}"
 			x := 5
 
-			i := 0
-			for {
-				val1 := fmt.Sprintf(template1, i)
-				val2 := fmt.Sprintf(template2, i)
-				if Hash(val1)[:x] == Hash(val2)[:x] {
-					fmt.Println(val1)
-					fmt.Println(Hash(val1))
-					fmt.Println(val2)
-					fmt.Println(Hash(val2))
-					break
+			seen := map[string]string{}
+			for i := 0; ; i++ {
+				for _, val := range []string{fmt.Sprintf(template1, i), fmt.Sprintf(template2, i)} {
+					key := EncodeBase62(Hash(val))[:x]
+					if other, ok := seen[key]; ok {
+						fmt.Println(other)
+						fmt.Println(val)
+						return
+					}
+					seen[key] = val
 				}
-				i += 1
 			}
 		}
 	*/
 	clearDb()
 	var respBody1 CreateImmutableDrawingResponse
 	// The following json objects are known to share the same
-	// first 5 hash characters for SHA512.
+	// first 5 base62 hash characters for SHA512.
 	resp1 := Post(
 		DRAWINGS_API+"immutable",
-		CreateImmutableDrawingRequest{Data: "{\"test\": \"1798285\"}"},
+		CreateImmutableDrawingRequest{Data: "{\"25222\": \"test\"}"},
 		&respBody1,
 	)
 	var respBody2 CreateImmutableDrawingResponse
 	resp2 := Post(
 		DRAWINGS_API+"immutable",
-		CreateImmutableDrawingRequest{Data: "{\"1798285\": \"test\"}"},
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"48098\"}"},
 		&respBody2,
 	)
 	assert.Equal(t, http.StatusOK, resp1.StatusCode)
 	assert.Equal(t, http.StatusOK, resp2.StatusCode)
-	assert.Equal(t, "66d57", respBody1.ShortKey)
-	assert.Equal(t, "66d57e", respBody2.ShortKey)
+	assert.Equal(t, "O4uLo", respBody1.ShortKey)
+	assert.Equal(t, "O4uLo0", respBody2.ShortKey)
+}
+
+func TestCreateImmutableDrawing_existingHexKey(t *testing.T) {
+	clearDb()
+	// Drawings shared before short keys were base62 keep their hex short key.
+	data := "{\"test\": \"test\"}"
+	db.Exec(
+		"INSERT INTO immutable_drawings (short_key, hash, data) VALUES (?, ?, ?)",
+		"c59e4",
+		Hash(data),
+		data,
+	)
+	var respBody1 CreateImmutableDrawingResponse
+	resp := Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: data},
+		&respBody1,
+	)
+	var respBody2 GetImmutableDrawingResponse
+	Get(DRAWINGS_API+"immutable/c59e4", &respBody2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "c59e4", respBody1.ShortKey)
+	assert.Equal(t, data, respBody2.Data)
+}
+
+func TestGetImmutableDrawing_caseSensitiveKeys(t *testing.T) {
+	clearDb()
+	_, err1 := db.Exec(
+		"INSERT INTO immutable_drawings (short_key, hash, data) VALUES ('Ab3x1', 'a', '{\"a\": 1}')",
+	)
+	_, err2 := db.Exec(
+		"INSERT INTO immutable_drawings (short_key, hash, data) VALUES ('aB3X1', 'b', '{\"b\": 1}')",
+	)
+	var respBody1, respBody2 GetImmutableDrawingResponse
+	Get(DRAWINGS_API+"immutable/Ab3x1", &respBody1)
+	Get(DRAWINGS_API+"immutable/aB3X1", &respBody2)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, "{\"a\": 1}", respBody1.Data)
+	assert.Equal(t, "{\"b\": 1}", respBody2.Data)
 }
 
 func TestGetImmutableDrawing_successful(t *testing.T) {
@@ -154,6 +193,235 @@ func TestGetImmutableDrawing_notFound(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
 
+func TestCreateImmutableDrawing_invalidExpiry(t *testing.T) {
+	clearDb()
+	var respBody1 GenericResponse
+	resp1 := Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", ExpiresIn: "-1h"},
+		&respBody1,
+	)
+	var respBody2 GenericResponse
+	resp2 := Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", ExpiresAt: "tomorrow"},
+		&respBody2,
+	)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, "Invalid expiry", respBody1.Error)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "Invalid expiry", respBody2.Error)
+}
+
+func TestCreateImmutableDrawing_restrictedNotShared(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}"},
+		&respBody1,
+	)
+	var respBody2 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", MaxViews: 1},
+		&respBody2,
+	)
+	assert.Equal(t, "JSK6S", respBody1.ShortKey)
+	assert.NotEqual(t, respBody1.ShortKey, respBody2.ShortKey)
+}
+
+func TestGetImmutableDrawing_maxViews(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", MaxViews: 2},
+		&respBody1,
+	)
+	resp1 := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &GetImmutableDrawingResponse{})
+	resp2 := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &GetImmutableDrawingResponse{})
+	var respBody2 GenericResponse
+	resp3 := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &respBody2)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, http.StatusGone, resp3.StatusCode)
+	assert.Equal(t, "Drawing expired", respBody2.Error)
+}
+
+func TestGetImmutableDrawing_expired(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", ExpiresIn: "1h"},
+		&respBody1,
+	)
+	var respBody2 GetImmutableDrawingResponse
+	resp1 := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &respBody2)
+	db.Exec(
+		"UPDATE immutable_drawings SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE WHERE short_key = ?",
+		respBody1.ShortKey,
+	)
+	resp2 := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &GenericResponse{})
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.NotEmpty(t, respBody2.ExpiresAt)
+	assert.Equal(t, http.StatusGone, resp2.StatusCode)
+}
+
+func TestGetImmutableDrawing_passwordRequired(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret"},
+		&respBody1,
+	)
+	var respBody2 GenericResponse
+	resp := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &respBody2)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Password required", respBody2.Error)
+}
+
+func TestUnlockImmutableDrawing_incorrectPassword(t *testing.T) {
+	clearDb()
+	client := MakeCookieClient()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret"},
+		&respBody1,
+	)
+	var respBody2 GenericResponse
+	resp1 := PostWithClient(
+		client,
+		DRAWINGS_API+"immutable/"+respBody1.ShortKey+"/unlock",
+		UnlockImmutableDrawingRequest{Password: "wrong"},
+		&respBody2,
+	)
+	resp2 := GetWithClient(client, DRAWINGS_API+"immutable/"+respBody1.ShortKey, &GenericResponse{})
+	assert.Equal(t, http.StatusUnauthorized, resp1.StatusCode)
+	assert.Equal(t, "Incorrect password", respBody2.Error)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+}
+
+func TestUnlockImmutableDrawing_successful(t *testing.T) {
+	clearDb()
+	client := MakeCookieClient()
+	var respBody1 CreateImmutableDrawingResponse
+	var respBody2 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret"},
+		&respBody1,
+	)
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret"},
+		&respBody2,
+	)
+	resp1 := PostWithClient(
+		client,
+		DRAWINGS_API+"immutable/"+respBody1.ShortKey+"/unlock",
+		UnlockImmutableDrawingRequest{Password: "secret"},
+		&GenericResponse{},
+	)
+	var respBody3 GetImmutableDrawingResponse
+	resp2 := GetWithClient(client, DRAWINGS_API+"immutable/"+respBody1.ShortKey, &respBody3)
+	// Access is only granted to the unlocked short key.
+	resp3 := GetWithClient(client, DRAWINGS_API+"immutable/"+respBody2.ShortKey, &GenericResponse{})
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "{\"test\": \"test\"}", respBody3.Data)
+	assert.Equal(t, http.StatusUnauthorized, resp3.StatusCode)
+}
+
+func TestUnlockImmutableDrawing_lockedOut(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret"},
+		&respBody1,
+	)
+	unlockUrl := DRAWINGS_API + "immutable/" + respBody1.ShortKey + "/unlock"
+	for range MaxImmutableDrawingPasswordFailures {
+		Post(unlockUrl, UnlockImmutableDrawingRequest{Password: "wrong"}, &GenericResponse{})
+	}
+	var respBody2 GenericResponse
+	resp1 := Post(unlockUrl, UnlockImmutableDrawingRequest{Password: "secret"}, &respBody2)
+	// Once the lockout has passed, the right password works again.
+	db.Exec("UPDATE immutable_drawings SET password_failed_at = UTC_TIMESTAMP() - INTERVAL 1 HOUR")
+	resp2 := Post(unlockUrl, UnlockImmutableDrawingRequest{Password: "secret"}, &GenericResponse{})
+	assert.Equal(t, http.StatusTooManyRequests, resp1.StatusCode)
+	assert.Equal(t, "Too many attempts, try again later", respBody2.Error)
+	assert.Equal(t, http.StatusAccepted, resp2.StatusCode)
+}
+
+func TestUnlockImmutableDrawing_expired(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", Password: "secret", ExpiresIn: "1h"},
+		&respBody1,
+	)
+	db.Exec("UPDATE immutable_drawings SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	var respBody2 GenericResponse
+	resp := Post(
+		DRAWINGS_API+"immutable/"+respBody1.ShortKey+"/unlock",
+		UnlockImmutableDrawingRequest{Password: "secret"},
+		&respBody2,
+	)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	assert.Equal(t, "Drawing expired", respBody2.Error)
+}
+
+func TestCreateImmutableDrawing_badData(t *testing.T) {
+	clearDb()
+	resp := Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "not json"},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestCreateImmutableDrawing_encryptedDuplicate(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	var respBody2 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "q83vEjRWeJCrze8=", Algorithm: "AES-GCM"},
+		&respBody1,
+	)
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "q83vEjRWeJCrze8=", Algorithm: "AES-GCM"},
+		&respBody2,
+	)
+	assert.NotEmpty(t, respBody1.ShortKey)
+	assert.Equal(t, respBody1.ShortKey, respBody2.ShortKey)
+}
+
+func TestGetImmutableDrawing_encrypted(t *testing.T) {
+	clearDb()
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "q83vEjRWeJCrze8=", Algorithm: "AES-GCM"},
+		&respBody1,
+	)
+	var respBody2 GetEncryptedImmutableDrawingResponse
+	resp := Get(DRAWINGS_API+"immutable/"+respBody1.ShortKey, &respBody2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, respBody2.Encrypted)
+	assert.Equal(t, "q83vEjRWeJCrze8=", respBody2.Ciphertext)
+	assert.Equal(t, "AES-GCM", respBody2.Algorithm)
+	assert.Equal(t, 2, respBody2.Hits)
+}
+
 func TestCreateMutableDrawing_unauthorized(t *testing.T) {
 	clearDb()
 	var respBody CreateMutableDrawingResponse
@@ -469,7 +737,132 @@ func TestListMutableDrawings_successful(t *testing.T) {
 	)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Len(t, respBody.Results, 3)
-	assert.Equal(t, "test1", respBody.Results[0].Name)
+	assert.Equal(t, 3, respBody.Total)
+	assert.Empty(t, respBody.NextCursor)
+	// Newest first
+	assert.Equal(t, "test3", respBody.Results[0].Name)
 	assert.Equal(t, "test2", respBody.Results[1].Name)
-	assert.Equal(t, "test3", respBody.Results[2].Name)
+	assert.Equal(t, "test1", respBody.Results[2].Name)
+}
+
+func TestListMutableDrawings_paginated(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	for _, name := range []string{"test1", "test2", "test3"} {
+		CreateTestMutableDrawing(client, name)
+	}
+	var respBody1 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables?limit=2", &respBody1)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(
+		client, DRAWINGS_API+"mutables?limit=2&cursor="+respBody1.NextCursor, &respBody2,
+	)
+	assert.Len(t, respBody1.Results, 2)
+	assert.Equal(t, 3, respBody1.Total)
+	assert.NotEmpty(t, respBody1.NextCursor)
+	assert.Equal(t, "test3", respBody1.Results[0].Name)
+	assert.Equal(t, "test2", respBody1.Results[1].Name)
+	assert.Len(t, respBody2.Results, 1)
+	assert.Empty(t, respBody2.NextCursor)
+	assert.Equal(t, "test1", respBody2.Results[0].Name)
+}
+
+func TestListMutableDrawings_sortAndFilter(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	for _, name := range []string{"payments-b", "ledger", "payments-a", "old payments"} {
+		CreateTestMutableDrawing(client, name)
+	}
+	var respBody1 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables?sort=name&name_prefix=payments", &respBody1)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(
+		client, DRAWINGS_API+"mutables?sort=name&order=desc&name_contains=payments", &respBody2,
+	)
+	assert.Len(t, respBody1.Results, 2)
+	assert.Equal(t, 2, respBody1.Total)
+	assert.Equal(t, "payments-a", respBody1.Results[0].Name)
+	assert.Equal(t, "payments-b", respBody1.Results[1].Name)
+	assert.Len(t, respBody2.Results, 3)
+	assert.Equal(t, "payments-b", respBody2.Results[0].Name)
+	assert.Equal(t, "payments-a", respBody2.Results[1].Name)
+	assert.Equal(t, "old payments", respBody2.Results[2].Name)
+}
+
+func TestListMutableDrawings_badRequest(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	resp1 := GetWithClient(client, DRAWINGS_API+"mutables?sort=size", &GenericResponse{})
+	resp2 := GetWithClient(client, DRAWINGS_API+"mutables?cursor=nonsense", &GenericResponse{})
+	assert.Equal(t, http.StatusBadRequest, resp1.StatusCode)
+	assert.Equal(t, http.StatusBadRequest, resp2.StatusCode)
+}
+
+func TestDuplicateMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	TagTestMutableDrawing(client, drawingId, "draft")
+	var respBody1 CreateMutableDrawingResponse
+	resp := PostWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/duplicate", drawingId), nil, &respBody1)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", respBody1.Id), &respBody2)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "test1 (copy)", respBody2.Name)
+	assert.Equal(t, "{\"test\": \"test\"}", respBody2.Data)
+	assert.Equal(t, []string{"draft"}, respBody2.Tags)
+	assert.Equal(t, drawingId, respBody2.ForkedFromId)
+}
+
+func TestDuplicateMutableDrawing_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	resp := PostWithClient(client2, DRAWINGS_API+fmt.Sprintf("mutable/%d/duplicate", drawingId), nil, &GenericResponse{})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestForkImmutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	var respBody1 CreateMutableDrawingResponse
+	resp := PostWithClient(client, DRAWINGS_API+"immutable/"+shortKey+"/fork", nil, &respBody1)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", respBody1.Id), &respBody2)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, shortKey, respBody2.Name)
+	assert.Equal(t, "{\"test\": \"test\"}", respBody2.Data)
+	assert.Equal(t, shortKey, respBody2.ForkedFromShortKey)
+	assert.Equal(t, 0, respBody2.ForkedFromId)
+}
+
+func TestForkImmutableDrawing_notFound(t *testing.T) {
+	clearDb()
+	userId, client := LoginUser("test@test.com")
+	resp := PostWithClient(client, DRAWINGS_API+"immutable/nothing/fork", nil, &GenericResponse{})
+	id, err := ForkImmutableDrawing(db, "nothing", "nothing", "{}", userId)
+	var drawings int
+	db.QueryRow("SELECT COUNT(*) FROM mutable_drawings").Scan(&drawings)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, id)
+	assert.Equal(t, 0, drawings)
+}
+
+func TestForkImmutableDrawing_expired(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1 CreateImmutableDrawingResponse
+	Post(
+		DRAWINGS_API+"immutable",
+		CreateImmutableDrawingRequest{Data: "{\"test\": \"test\"}", ExpiresIn: "1h"},
+		&respBody1,
+	)
+	db.Exec("UPDATE immutable_drawings SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	var respBody2 GenericResponse
+	resp := PostWithClient(client, DRAWINGS_API+"immutable/"+respBody1.ShortKey+"/fork", nil, &respBody2)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	assert.Equal(t, "Drawing expired", respBody2.Error)
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func CreateTestEditLink(client *http.Client, drawingId int, request CreateEditLinkRequest) CreateEditLinkResponse {
+	var respBody CreateEditLinkResponse
+	PostWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/edit-links", drawingId), request, &respBody)
+	return respBody
+}
+
+func TestEditLink_getAndUpdate(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	link := CreateTestEditLink(client, drawingId, CreateEditLinkRequest{})
+	var respBody1 GetEditLinkDrawingResponse
+	resp1 := Get(DRAWINGS_API+"edit/"+link.Token, &respBody1)
+	resp2 := Patch(
+		DRAWINGS_API+"edit/"+link.Token,
+		UpdateMutableDrawingRequest{Data: "{\"test\": \"updated\"}"},
+		&GenericResponse{},
+	)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &respBody2)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, "test1", respBody1.Name)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "{\"test\": \"updated\"}", respBody2.Data)
+}
+
+func TestEditLink_history(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	link := CreateTestEditLink(client, drawingId, CreateEditLinkRequest{})
+	PatchWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId),
+		UpdateMutableDrawingRequest{Name: "test2"},
+		&GenericResponse{},
+	)
+	Patch(DRAWINGS_API+"edit/"+link.Token, UpdateMutableDrawingRequest{Name: "test3"}, &GenericResponse{})
+	var respBody ListMutableDrawingHistoryResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/history", drawingId), &respBody)
+	assert.Len(t, respBody.Results, 2)
+	assert.Equal(t, "link user", respBody.Results[0].Editor)
+	assert.Equal(t, link.Id, respBody.Results[0].EditLinkId)
+	assert.Equal(t, "owner", respBody.Results[1].Editor)
+}
+
+func TestEditLink_revoked(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	link := CreateTestEditLink(client, drawingId, CreateEditLinkRequest{})
+	resp1 := DeleteWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d/edit-links/%d", drawingId, link.Id), &GenericResponse{},
+	)
+	resp2 := Get(DRAWINGS_API+"edit/"+link.Token, &GenericResponse{})
+	var respBody ListEditLinksResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/edit-links", drawingId), &respBody)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.NotEmpty(t, respBody.Results[0].RevokedAt)
+}
+
+func TestEditLink_expired(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	link := CreateTestEditLink(client, drawingId, CreateEditLinkRequest{ExpiresIn: "1s"})
+	db.Exec("UPDATE edit_links SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	resp := Get(DRAWINGS_API+"edit/"+link.Token, &GenericResponse{})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestEditLink_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	resp := PostWithClient(
+		client2,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/edit-links", drawingId),
+		CreateEditLinkRequest{},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func GetTestExport(client *http.Client, url string) (*http.Response, *zip.Reader) {
+	resp, err := client.Get(url)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		panic(err)
+	}
+	return resp, archive
+}
+
+func ReadTestExportFile(archive *zip.Reader, name string) string {
+	file, err := archive.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		panic(err)
+	}
+	return string(content)
+}
+
+func TestExportMutableDrawings_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	folderId := CreateTestFolder(client, "payments", 0)
+	drawingId1 := CreateTestMutableDrawing(client, "ledger service")
+	drawingId2 := CreateTestMutableDrawing(client, "other")
+	PostWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/move", drawingId1),
+		MoveMutableDrawingRequest{FolderId: folderId},
+		&GenericResponse{},
+	)
+	TagTestMutableDrawing(client, drawingId1, "draft")
+	DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId2), &GenericResponse{})
+
+	resp, archive := GetTestExport(client, DRAWINGS_API+"export?include_text=true")
+	var manifest ExportManifest
+	json.Unmarshal([]byte(ReadTestExportFile(archive, "manifest.json")), &manifest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	assert.Len(t, manifest.Drawings, 1)
+	assert.Equal(t, "drawings/1-ledger-service.json", manifest.Drawings[0].File)
+	assert.Equal(t, "drawings/1-ledger-service.txt", manifest.Drawings[0].TextFile)
+	assert.Equal(t, "payments", manifest.Drawings[0].FolderPath)
+	assert.Equal(t, []string{"draft"}, manifest.Drawings[0].Tags)
+	assert.JSONEq(t, "{\"test\": \"test\"}", ReadTestExportFile(archive, manifest.Drawings[0].File))
+	assert.Equal(t, "test", ReadTestExportFile(archive, manifest.Drawings[0].TextFile))
+}
+
+func TestExportMutableDrawings_unauthorized(t *testing.T) {
+	clearDb()
+	resp := Get(DRAWINGS_API+"export", &GenericResponse{})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var FOLDERS_API = "http://localhost:8000/api/folders/"
+
+func CreateTestFolder(client *http.Client, name string, parentId int) int {
+	var respBody CreateFolderResponse
+	PostWithClient(
+		client,
+		FOLDERS_API,
+		CreateFolderRequest{Name: name, ParentId: parentId},
+		&respBody,
+	)
+	return respBody.Id
+}
+
+func TestCreateFolder_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1 CreateFolderResponse
+	resp := PostWithClient(client, FOLDERS_API, CreateFolderRequest{Name: "payments"}, &respBody1)
+	CreateTestFolder(client, "ledger", respBody1.Id)
+	var respBody2 ListFoldersResponse
+	GetWithClient(client, FOLDERS_API, &respBody2)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Len(t, respBody2.Results, 2)
+	assert.Equal(t, "ledger", respBody2.Results[0].Name)
+	assert.Equal(t, respBody1.Id, respBody2.Results[0].ParentId)
+	assert.Equal(t, "payments", respBody2.Results[1].Name)
+	assert.Equal(t, 0, respBody2.Results[1].ParentId)
+}
+
+func TestCreateFolder_differentUserParent(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	folderId := CreateTestFolder(client1, "payments", 0)
+	resp := PostWithClient(
+		client2,
+		FOLDERS_API,
+		CreateFolderRequest{Name: "ledger", ParentId: folderId},
+		&CreateFolderResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRenameFolder_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	folderId := CreateTestFolder(client, "payments", 0)
+	resp := PatchWithClient(
+		client,
+		FOLDERS_API+fmt.Sprint(folderId),
+		RenameFolderRequest{Name: "ledger"},
+		&GenericResponse{},
+	)
+	var respBody ListFoldersResponse
+	GetWithClient(client, FOLDERS_API, &respBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ledger", respBody.Results[0].Name)
+}
+
+func TestMoveFolder_intoItself(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	parentId := CreateTestFolder(client, "payments", 0)
+	childId := CreateTestFolder(client, "ledger", parentId)
+	resp := PostWithClient(
+		client,
+		FOLDERS_API+fmt.Sprintf("%d/move", parentId),
+		MoveFolderRequest{ParentId: childId},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMoveMutableDrawing_listByFolder(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	folderId := CreateTestFolder(client, "payments", 0)
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	CreateTestMutableDrawing(client, "test2")
+	resp := PostWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/move", drawingId),
+		MoveMutableDrawingRequest{FolderId: folderId},
+		&GenericResponse{},
+	)
+	var respBody1 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutables?folder_id=%d", folderId), &respBody1)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables?folder_id=0", &respBody2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, respBody1.Results, 1)
+	assert.Equal(t, "test1", respBody1.Results[0].Name)
+	assert.Equal(t, folderId, respBody1.Results[0].FolderId)
+	assert.Len(t, respBody2.Results, 1)
+	assert.Equal(t, "test2", respBody2.Results[0].Name)
+}
+
+func TestMoveMutableDrawing_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	folderId := CreateTestFolder(client2, "payments", 0)
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	resp := PostWithClient(
+		client2,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/move", drawingId),
+		MoveMutableDrawingRequest{FolderId: folderId},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeleteFolder_notEmpty(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	parentId := CreateTestFolder(client, "payments", 0)
+	CreateTestFolder(client, "ledger", parentId)
+	var respBody GenericResponse
+	resp := DeleteWithClient(client, FOLDERS_API+fmt.Sprint(parentId), &respBody)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "Folder not empty", respBody.Error)
+}
+
+func TestDeleteFolder_recursive(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	parentId := CreateTestFolder(client, "payments", 0)
+	childId := CreateTestFolder(client, "ledger", parentId)
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	PostWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/move", drawingId),
+		MoveMutableDrawingRequest{FolderId: childId},
+		&GenericResponse{},
+	)
+	resp1 := DeleteWithClient(
+		client, FOLDERS_API+fmt.Sprintf("%d?recursive=true", parentId), &GenericResponse{},
+	)
+	var respBody ListFoldersResponse
+	GetWithClient(client, FOLDERS_API, &respBody)
+	resp2 := GetWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GetMutableDrawingResponse{},
+	)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Empty(t, respBody.Results)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+}
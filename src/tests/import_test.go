@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ImportTestFiles(client *http.Client, files map[string]string, res any) *http.Response {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for name, content := range files {
+		part, err := writer.CreateFormFile("files", name)
+		if err != nil {
+			panic(err)
+		}
+		io.WriteString(part, content)
+	}
+	writer.Close()
+	resp, err := client.Post(DRAWINGS_API+"import", writer.FormDataContentType(), &buf)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func TestImportMutableDrawings_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1 ImportMutableDrawingsResponse
+	resp := ImportTestFiles(client, map[string]string{"ledger.json": "{\"test\": \"ledger\"}"}, &respBody1)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", respBody1.Results[0].Id), &respBody2)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, 1, respBody1.Imported)
+	assert.Equal(t, "ledger", respBody2.Name)
+	assert.Equal(t, "{\"test\": \"ledger\"}", respBody2.Data)
+}
+
+func TestImportMutableDrawings_duplicate(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	var respBody ImportMutableDrawingsResponse
+	// Formatted differently, but the same drawing.
+	ImportTestFiles(client, map[string]string{"test2.json": "{\"test\":\"test\"}"}, &respBody)
+	assert.Equal(t, 0, respBody.Imported)
+	assert.Equal(t, drawingId, respBody.Results[0].DuplicateOf)
+}
+
+func TestImportMutableDrawings_invalidNothingImported(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1 ImportMutableDrawingsResponse
+	resp := ImportTestFiles(
+		client,
+		map[string]string{"good.json": "{\"test\": \"test\"}", "bad.json": "not json"},
+		&respBody1,
+	)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables", &respBody2)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Len(t, respBody1.Results, 2)
+	assert.Equal(t, 0, respBody2.Total)
+}
+
+func TestImportMutableDrawings_fromExport(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "ledger service")
+	TagTestMutableDrawing(client1, drawingId, "draft")
+	resp, _ := client1.Get(DRAWINGS_API + "export?include_text=true")
+	archive, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var respBody1 ImportMutableDrawingsResponse
+	ImportTestFiles(client2, map[string]string{"export.zip": string(archive)}, &respBody1)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client2, DRAWINGS_API+fmt.Sprintf("mutable/%d", respBody1.Results[0].Id), &respBody2)
+	assert.Equal(t, 1, respBody1.Imported)
+	assert.Equal(t, "ledger service", respBody2.Name)
+	assert.Equal(t, []string{"draft"}, respBody2.Tags)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// StartTestRegistrationApp serves the API in this process, with its own
+// registration mode and admins.
+func StartTestRegistrationApp(mode string, admins ...string) *httptest.Server {
+	RegistrationMode = mode
+	RegistrationDomains = []string{"corp.com"}
+	AdminEmails = admins
+	router := mux.NewRouter()
+	AddApiRoutes(router, &Servicers{db: db})
+	return httptest.NewServer(router)
+}
+
+func StopTestRegistrationApp(app *httptest.Server) {
+	app.Close()
+	RegistrationMode = RegistrationOpen
+	RegistrationDomains = nil
+	AdminEmails = nil
+}
+
+func TestInvites_signupTracked(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("inviter@test.com")
+	var inviteBody CreateInviteResponse
+	resp := PostWithClient(client, USER_API+"invites", CreateInviteRequest{}, &inviteBody)
+
+	var signupBody1, signupBody2 GenericResponse
+	resp1 := Post(USER_API, CreateUserRequest{
+		Email: "invitee@test.com", Password: "12345", InviteCode: inviteBody.Code,
+	}, &signupBody1)
+	// It's single use by default, but no invite is needed to sign up here.
+	resp2 := Post(USER_API, CreateUserRequest{
+		Email: "other@test.com", Password: "12345", InviteCode: inviteBody.Code,
+	}, &signupBody2)
+	var otherInvited bool
+	db.QueryRow("SELECT invite_id IS NOT NULL FROM users WHERE email = 'other@test.com'").Scan(&otherInvited)
+
+	var listBody ListInvitesResponse
+	GetWithClient(client, USER_API+"invites", &listBody)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, inviteBody.Url, "/i/"+inviteBody.Code)
+	assert.Equal(t, http.StatusCreated, resp1.StatusCode)
+	assert.Equal(t, http.StatusCreated, resp2.StatusCode)
+	assert.False(t, otherInvited)
+	assert.Equal(t, []InviteResponse{{
+		Id:        inviteBody.Id,
+		IssuedBy:  "inviter@test.com",
+		MaxUses:   1,
+		Uses:      1,
+		CreatedAt: listBody.Results[0].CreatedAt,
+		Invitees:  []string{"invitee@test.com"},
+	}}, listBody.Results)
+}
+
+func TestInvites_revokedAndExpired(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("inviter@test.com")
+	var inviteBody1, inviteBody2 CreateInviteResponse
+	PostWithClient(client, USER_API+"invites", CreateInviteRequest{}, &inviteBody1)
+	PostWithClient(client, USER_API+"invites", CreateInviteRequest{ExpiresIn: "1h"}, &inviteBody2)
+	db.Exec("UPDATE invites SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE WHERE id = ?", inviteBody2.Id)
+	app := StartTestRegistrationApp(RegistrationInvite)
+	defer StopTestRegistrationApp(app)
+
+	var revokeBody1, revokeBody2 GenericResponse
+	resp1 := DeleteWithClient(client, USER_API+fmt.Sprintf("invites/%d", inviteBody1.Id), &revokeBody1)
+	resp2 := DeleteWithClient(client, USER_API+fmt.Sprintf("invites/%d", inviteBody1.Id), &revokeBody2)
+	var signupBody1, signupBody2 GenericResponse
+	resp3 := Post(app.URL+"/api/user/", CreateUserRequest{
+		Email: "invitee@test.com", Password: "12345", InviteCode: inviteBody1.Code,
+	}, &signupBody1)
+	resp4 := Post(app.URL+"/api/user/", CreateUserRequest{
+		Email: "invitee@test.com", Password: "12345", InviteCode: inviteBody2.Code,
+	}, &signupBody2)
+
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+	assert.Equal(t, http.StatusForbidden, resp3.StatusCode)
+	assert.Equal(t, "Invalid or expired invite", signupBody1.Error)
+	assert.Equal(t, http.StatusForbidden, resp4.StatusCode)
+}
+
+func TestInvites_othersCantRevoke(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("inviter@test.com")
+	_, client2 := LoginUser("other@test.com")
+	var inviteBody CreateInviteResponse
+	PostWithClient(client1, USER_API+"invites", CreateInviteRequest{}, &inviteBody)
+
+	var respBody GenericResponse
+	resp := DeleteWithClient(client2, USER_API+fmt.Sprintf("invites/%d", inviteBody.Id), &respBody)
+	var listBody ListInvitesResponse
+	GetWithClient(client2, USER_API+"invites", &listBody)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, listBody.Results)
+}
+
+func TestInvites_userLimits(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("inviter@test.com")
+	unlimited, tooMany := 0, MaxUserInviteUses+1
+	var respBody1, respBody2 GenericResponse
+	PostWithClient(client, USER_API+"invites", CreateInviteRequest{MaxUses: &unlimited}, &respBody1)
+	PostWithClient(client, USER_API+"invites", CreateInviteRequest{MaxUses: &tooMany}, &respBody2)
+	var listBody GenericResponse
+	resp := GetWithClient(client, USER_API+"invites?all=true", &listBody)
+	assert.Equal(t, "Invites can be used at most 20 times", respBody1.Error)
+	assert.Equal(t, "Invites can be used at most 20 times", respBody2.Error)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestInvites_admin(t *testing.T) {
+	clearDb()
+	app := StartTestRegistrationApp(RegistrationInvite, "admin@test.com")
+	defer StopTestRegistrationApp(app)
+	inviterId, _ := LoginUser("inviter@test.com")
+	LoginUser("admin@test.com")
+	// Log in again, this time with the app admin@test.com is an admin of.
+	adminClient := MakeCookieClient()
+	PostWithClient(adminClient, app.URL+"/api/user/auth", AuthUserRequest{
+		Email: "admin@test.com", Password: "12345",
+	}, &GenericResponse{})
+	// They're not an admin until they've shown the email is theirs.
+	resp1 := GetWithClient(adminClient, app.URL+"/api/user/invites?all=true", &GenericResponse{})
+	db.Exec("UPDATE users SET verified_at = UTC_TIMESTAMP() WHERE email = 'admin@test.com'")
+
+	inviteId, _, _ := CreateInvite(db, inviterId, nil, nil)
+	var inviteBody2 CreateInviteResponse
+	unlimited := 0
+	PostWithClient(adminClient, app.URL+"/api/user/invites", CreateInviteRequest{MaxUses: &unlimited}, &inviteBody2)
+	for _, email := range []string{"a@test.com", "b@test.com", "c@test.com"} {
+		Post(app.URL+"/api/user/", CreateUserRequest{
+			Email: email, Password: "12345", InviteCode: inviteBody2.Code,
+		}, &GenericResponse{})
+	}
+	var listBody ListInvitesResponse
+	GetWithClient(adminClient, app.URL+"/api/user/invites?all=true", &listBody)
+	var revokeBody GenericResponse
+	resp2 := DeleteWithClient(adminClient, app.URL+fmt.Sprintf("/api/user/invites/%d", inviteId), &revokeBody)
+
+	assert.Equal(t, http.StatusForbidden, resp1.StatusCode)
+	assert.Equal(t, 2, len(listBody.Results))
+	assert.Equal(t, "admin@test.com", listBody.Results[0].IssuedBy)
+	assert.Equal(t, 0, listBody.Results[0].MaxUses)
+	assert.Equal(t, []string{"a@test.com", "b@test.com", "c@test.com"}, listBody.Results[0].Invitees)
+	assert.Equal(t, "inviter@test.com", listBody.Results[1].IssuedBy)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+}
+
+func TestRegistration_modes(t *testing.T) {
+	cases := []struct {
+		mode    string
+		email   string
+		invited bool
+		status  int
+	}{
+		{RegistrationOpen, "test@elsewhere.com", false, http.StatusCreated},
+		{RegistrationDomain, "test@corp.com", false, http.StatusCreated},
+		{RegistrationDomain, "test@elsewhere.com", false, http.StatusForbidden},
+		{RegistrationDomain, "test@elsewhere.com", true, http.StatusCreated},
+		{RegistrationOpen, "test@elsewhere.com", true, http.StatusCreated},
+		{RegistrationInvite, "test@corp.com", false, http.StatusForbidden},
+		{RegistrationInvite, "test@corp.com", true, http.StatusCreated},
+		{RegistrationClosed, "test@corp.com", true, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		clearDb()
+		inviterId, _ := LoginUser("inviter@test.com")
+		_, code, _ := CreateInvite(db, inviterId, nil, nil)
+		app := StartTestRegistrationApp(c.mode)
+		request := CreateUserRequest{Email: c.email, Password: "12345"}
+		if c.invited {
+			request.InviteCode = code
+		}
+		resp := Post(app.URL+"/api/user/", request, &GenericResponse{})
+		StopTestRegistrationApp(app)
+		assert.Equal(t, c.status, resp.StatusCode, "%s %s invited=%v", c.mode, c.email, c.invited)
+	}
+}
+
+func TestRegistration_existingUserNotRevealed(t *testing.T) {
+	cases := []struct {
+		mode       string
+		inviteCode string
+		status     int
+		message    string
+	}{
+		{RegistrationClosed, "", http.StatusForbidden, "Registration is closed"},
+		{RegistrationInvite, "", http.StatusForbidden, "An invite is needed to sign up"},
+		{RegistrationInvite, "bad", http.StatusForbidden, "Invalid or expired invite"},
+		{RegistrationDomain, "", http.StatusForbidden, "Email domain not allowed, an invite is needed to sign up"},
+		{RegistrationOpen, "bad", http.StatusOK, "User already exists"},
+	}
+	for _, c := range cases {
+		clearDb()
+		LoginUser("test@elsewhere.com")
+		app := StartTestRegistrationApp(c.mode)
+		var respBody GenericResponse
+		resp := Post(app.URL+"/api/user/", CreateUserRequest{
+			Email: "test@elsewhere.com", Password: "12345", InviteCode: c.inviteCode,
+		}, &respBody)
+		StopTestRegistrationApp(app)
+		assert.Equal(t, c.status, resp.StatusCode, "%s %q", c.mode, c.inviteCode)
+		assert.Equal(t, c.message, respBody.Error, "%s %q", c.mode, c.inviteCode)
+	}
+}
+
+func TestInvites_inviterDeleted(t *testing.T) {
+	clearDb()
+	inviterId, _ := LoginUser("inviter@test.com")
+	_, code, _ := CreateInvite(db, inviterId, nil, nil)
+	inviteeId, _ := CreateInvitedUser(db, "invitee@test.com", "12345", code)
+	err := DeleteUser(db, inviterId)
+	var invites int
+	var email string
+	db.QueryRow("SELECT COUNT(*) FROM invites").Scan(&invites)
+	db.QueryRow("SELECT email FROM users WHERE id = ?", inviteeId).Scan(&email)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, invites)
+	assert.Equal(t, "invitee@test.com", email)
+}
+
+func TestLoadRegistrationMode(t *testing.T) {
+	assert.Equal(t, RegistrationOpen, LoadRegistrationMode(""))
+	assert.Equal(t, RegistrationInvite, LoadRegistrationMode("invite"))
+	assert.Equal(t, RegistrationClosed, LoadRegistrationMode("invites"))
+}
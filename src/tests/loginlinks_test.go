@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func RequestTestLoginLink(email string) string {
+	Post(USER_API+"login-link", LoginLinkRequest{Email: email}, &GenericResponse{})
+	_, token, _ := strings.Cut(ReadLatestMailLink(email), "/l/")
+	return token
+}
+
+func TestLoginLink_successful(t *testing.T) {
+	clearDb()
+	// The email wasn't verified, so whoever signed up with it may not be its owner.
+	userId, squatter := LoginUser("test@test.com")
+	token := RequestTestLoginLink("test@test.com")
+	client := MakeCookieClient()
+	resp1 := PostWithClient(client, USER_API+"login-link/redeem", RedeemLoginLinkRequest{Token: token}, &GenericResponse{})
+	var respBody UserResponse
+	GetWithClient(client, USER_API, &respBody)
+	resp2 := GetWithClient(squatter, USER_API, &GenericResponse{})
+	passwordUserId, err := Authenticate(db, "test@test.com", "12345")
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, userId, respBody.Id)
+	assert.True(t, respBody.Verified)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, passwordUserId)
+}
+
+func TestLoginLink_verifiedKeepsPassword(t *testing.T) {
+	clearDb()
+	userId, client1 := LoginUser("test@test.com")
+	db.Exec("UPDATE users SET verified_at = UTC_TIMESTAMP()")
+	token := RequestTestLoginLink("test@test.com")
+	Post(USER_API+"login-link/redeem", RedeemLoginLinkRequest{Token: token}, &GenericResponse{})
+	resp := GetWithClient(client1, USER_API, &GenericResponse{})
+	passwordUserId, err := Authenticate(db, "test@test.com", "12345")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, userId, passwordUserId)
+}
+
+func TestLoginLink_singleUse(t *testing.T) {
+	clearDb()
+	LoginUser("test@test.com")
+	token := RequestTestLoginLink("test@test.com")
+	Post(USER_API+"login-link/redeem", RedeemLoginLinkRequest{Token: token}, &GenericResponse{})
+	var respBody GenericResponse
+	resp := Post(USER_API+"login-link/redeem", RedeemLoginLinkRequest{Token: token}, &respBody)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Invalid or expired link", respBody.Error)
+}
+
+func TestLoginLink_expired(t *testing.T) {
+	clearDb()
+	LoginUser("test@test.com")
+	token := RequestTestLoginLink("test@test.com")
+	db.Exec("UPDATE login_links SET expires_at = UTC_TIMESTAMP() - INTERVAL 1 MINUTE")
+	resp := Post(USER_API+"login-link/redeem", RedeemLoginLinkRequest{Token: token}, &GenericResponse{})
+	purged, err := PurgeLoginLinks(db)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+}
+
+func TestLoginLink_throttled(t *testing.T) {
+	clearDb()
+	LoginUser("test@test.com")
+	token1 := RequestTestLoginLink("test@test.com")
+	mails := CountMails("test@test.com")
+	resp := Post(USER_API+"login-link", LoginLinkRequest{Email: "test@test.com"}, &GenericResponse{})
+	var links int
+	db.QueryRow("SELECT COUNT(*) FROM login_links").Scan(&links)
+	assert.NotEmpty(t, token1)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, mails, CountMails("test@test.com"))
+	assert.Equal(t, 1, links)
+}
+
+func TestLoginLink_unknownEmail(t *testing.T) {
+	clearDb()
+	resp := Post(USER_API+"login-link", LoginLinkRequest{Email: "nobody@test.com"}, &GenericResponse{})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Empty(t, ReadLatestMailLink("nobody@test.com"))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockIdp is a minimal OpenID Connect provider, which logs in whoever has its
+// Claims straight away.
+type MockIdp struct {
+	Server *httptest.Server
+	Key    *rsa.PrivateKey
+	Claims map[string]any
+	codes  map[string]url.Values
+}
+
+func NewMockIdp() *MockIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	idp := &MockIdp{Key: key, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.Server.URL,
+			"authorization_endpoint": idp.Server.URL + "/authorize",
+			"token_endpoint":         idp.Server.URL + "/token",
+			"jwks_uri":               idp.Server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(value *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(value.Bytes())
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   encode(key.N),
+			"e":   encode(big.NewInt(int64(key.E))),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "PKCE required", http.StatusBadRequest)
+			return
+		}
+		code := RandomBase62(16)
+		idp.codes[code] = query
+		redirect := query.Get("redirect_uri") + "?" + url.Values{
+			"code":  {code},
+			"state": {query.Get("state")},
+		}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		authorize, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		if !ok || PkceChallenge(r.PostForm.Get("code_verifier")) != authorize.Get("code_challenge") {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]any{
+			"iss":   idp.Server.URL,
+			"aud":   authorize.Get("client_id"),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": authorize.Get("nonce"),
+		}
+		for name, value := range idp.Claims {
+			claims[name] = value
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.Sign(claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *MockIdp) Sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// StartTestOidcApp serves the API in this process, so it can log in with the
+// mock provider configured here.
+func StartTestOidcApp(idp *MockIdp, provision bool, allowedDomains ...string) *httptest.Server {
+	router := mux.NewRouter()
+	AddApiRoutes(router, &Servicers{db: db})
+	app := httptest.NewServer(router)
+	OidcProviders = map[string]*OidcProvider{"mock": {
+		Name:           "mock",
+		DisplayName:    "Mock",
+		Issuer:         idp.Server.URL,
+		ClientId:       "cascii",
+		ClientSecret:   "secret",
+		Scopes:         []string{"openid", "email"},
+		AllowedDomains: allowedDomains,
+		Provision:      provision,
+		RedirectUri:    app.URL + "/api/user/oidc/mock/callback",
+	}}
+	return app
+}
+
+func LoginTestOidc(app *httptest.Server) (*http.Client, *http.Response, string) {
+	client := MakeCookieClient()
+	resp, err := client.Get(app.URL + "/api/user/oidc/mock/login")
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return client, resp, string(body)
+}
+
+func TestOidc_provisioned(t *testing.T) {
+	clearDb()
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, true, "corp.com")
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": true}
+
+	client, resp, body := LoginTestOidc(app)
+	var userBody UserResponse
+	GetWithClient(client, app.URL+"/api/user/", &userBody)
+	var identities int
+	db.QueryRow("SELECT COUNT(*) FROM user_identities WHERE provider = 'mock' AND subject = 'abc'").Scan(&identities)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `url=/"`)
+	assert.Equal(t, "test@corp.com", userBody.Email)
+	assert.True(t, userBody.Verified)
+	assert.Equal(t, 1, identities)
+}
+
+func TestOidc_linkedByEmailThenSubject(t *testing.T) {
+	clearDb()
+	userId, _ := LoginUser("test@corp.com")
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, false)
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": true}
+	client1, _, _ := LoginTestOidc(app)
+	// The provider's email changes, but the subject stays the same.
+	idp.Claims = map[string]any{"sub": "abc", "email": "renamed@corp.com"}
+	client2, _, _ := LoginTestOidc(app)
+
+	var userBody1, userBody2 UserResponse
+	GetWithClient(client1, app.URL+"/api/user/", &userBody1)
+	GetWithClient(client2, app.URL+"/api/user/", &userBody2)
+	assert.Equal(t, userId, userBody1.Id)
+	assert.Equal(t, userId, userBody2.Id)
+}
+
+func TestOidc_unverifiedAccountTakenBack(t *testing.T) {
+	clearDb()
+	// Someone else signed up with the email first, but never verified it.
+	userId, squatter := LoginUser("test@corp.com")
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, false)
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": true}
+	client, _, _ := LoginTestOidc(app)
+
+	var userBody UserResponse
+	GetWithClient(client, app.URL+"/api/user/", &userBody)
+	resp := GetWithClient(squatter, USER_API, &GenericResponse{})
+	passwordUserId, err := Authenticate(db, "test@corp.com", "12345")
+	assert.Equal(t, userId, userBody.Id)
+	assert.True(t, userBody.Verified)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, passwordUserId)
+}
+
+func TestOidc_notProvisioned(t *testing.T) {
+	clearDb()
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, false)
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": true}
+	_, resp, body := LoginTestOidc(app)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, "No account for this email")
+}
+
+func TestOidc_domainNotAllowed(t *testing.T) {
+	clearDb()
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, true, "corp.com")
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@elsewhere.com", "email_verified": true}
+	_, resp, body := LoginTestOidc(app)
+	var users int
+	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, "Email domain not allowed")
+	assert.Equal(t, 0, users)
+}
+
+func TestOidc_unverifiedEmail(t *testing.T) {
+	clearDb()
+	LoginUser("test@corp.com")
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, true)
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": false}
+	_, resp, body := LoginTestOidc(app)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, "Email not verified")
+}
+
+func TestOidc_forgedIdToken(t *testing.T) {
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	other := NewMockIdp()
+	defer other.Server.Close()
+	provider := &OidcProvider{Name: "mock", Issuer: idp.Server.URL, ClientId: "cascii"}
+	claims := map[string]any{
+		"iss": idp.Server.URL, "aud": "cascii", "sub": "abc", "nonce": "n",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	_, err1 := provider.VerifyIdToken(idp.Sign(claims), "n")
+	_, err2 := provider.VerifyIdToken(other.Sign(claims), "n")
+	_, err3 := provider.VerifyIdToken(idp.Sign(claims), "other")
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err4 := provider.VerifyIdToken(idp.Sign(claims), "n")
+	assert.Nil(t, err1)
+	assert.NotNil(t, err2)
+	assert.NotNil(t, err3)
+	assert.NotNil(t, err4)
+}
+
+func TestOidc_badState(t *testing.T) {
+	clearDb()
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, true)
+	defer app.Close()
+	var respBody GenericResponse
+	resp := Get(app.URL+"/api/user/oidc/mock/callback?code=abc&state=forged", &respBody)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Login expired, please try again", respBody.Error)
+}
+
+func TestOidc_passwordlessReauthentication(t *testing.T) {
+	clearDb()
+	idp := NewMockIdp()
+	defer idp.Server.Close()
+	app := StartTestOidcApp(idp, true)
+	defer app.Close()
+	idp.Claims = map[string]any{"sub": "abc", "email": "test@corp.com", "email_verified": true}
+	client1, _, _ := LoginTestOidc(app)
+	db.Exec("UPDATE sessions SET authenticated_at = UTC_TIMESTAMP() - INTERVAL 1 HOUR")
+	var respBody1, respBody2, respBody3 GenericResponse
+	resp1 := DeleteWithClientAndBody(client1, app.URL+"/api/user/", DeleteUserRequest{}, &respBody1)
+	// Logging in with the provider again is as good as a password.
+	client2, _, _ := LoginTestOidc(app)
+	resp2 := PostWithClient(client2, app.URL+"/api/user/password", ChangePasswordRequest{
+		NewPassword: "123456",
+	}, &respBody2)
+	// From then on, it's the password that's needed.
+	resp3 := DeleteWithClientAndBody(client2, app.URL+"/api/user/", DeleteUserRequest{}, &respBody3)
+	resp4 := DeleteWithClientAndBody(
+		client2, app.URL+"/api/user/", DeleteUserRequest{Password: "123456"}, &DeleteUserResponse{},
+	)
+
+	assert.Equal(t, http.StatusUnauthorized, resp1.StatusCode)
+	assert.Equal(t, "Log in again to do this", respBody1.Error)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp3.StatusCode)
+	assert.Equal(t, "Incorrect password", respBody3.Error)
+	assert.Equal(t, http.StatusAccepted, resp4.StatusCode)
+}
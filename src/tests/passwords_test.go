@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	argon2id := Argon2idHasher{Memory: 1024, Time: 1, Threads: 1}
+	stronger := Argon2idHasher{Memory: 2048, Time: 1, Threads: 1}
+	bcryptHasher := BcryptHasher{Cost: bcrypt.MinCost}
+	argon2idHash, err1 := argon2id.Hash("secret")
+	bcryptHash, err2 := bcryptHasher.Hash("secret")
+
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.True(t, strings.HasPrefix(argon2idHash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, argon2id.Check(argon2idHash, "secret"))
+	assert.True(t, stronger.Check(argon2idHash, "secret"))
+	assert.False(t, argon2id.Check(argon2idHash, "wrong"))
+	assert.False(t, argon2id.Check(bcryptHash, "secret"))
+	assert.False(t, bcryptHasher.Check(argon2idHash, "secret"))
+	assert.False(t, argon2id.Check("", ""))
+	assert.True(t, argon2id.IsCurrent(argon2idHash))
+	assert.False(t, stronger.IsCurrent(argon2idHash))
+	assert.True(t, bcryptHasher.IsCurrent(bcryptHash))
+	assert.False(t, BcryptHasher{Cost: 12}.IsCurrent(bcryptHash))
+	assert.True(t, CheckPassword(argon2idHash, "secret"))
+	assert.True(t, CheckPassword(bcryptHash, "secret"))
+}
+
+func TestAuthenticate_rehashed(t *testing.T) {
+	clearDb()
+	// As hashed before there was a choice of hashers.
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("12345"), 10)
+	db.Exec("INSERT INTO users (email, password) VALUES ('test@test.com', ?)", string(oldHash))
+	userId, err := Authenticate(db, "test@test.com", "12345")
+	var hash string
+	db.QueryRow("SELECT password FROM users WHERE id = ?", userId).Scan(&hash)
+	userId2, _ := Authenticate(db, "test@test.com", "12345")
+	wrongUserId, _ := Authenticate(db, "test@test.com", "wrong")
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, -1, userId)
+	assert.True(t, PreferredPasswordHasher.IsCurrent(hash))
+	assert.Equal(t, userId, userId2)
+	assert.Equal(t, -1, wrongUserId)
+}
+
+func TestCreateUser_breachedPassword(t *testing.T) {
+	clearDb()
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	os.WriteFile(path, []byte("password\r\nqwerty123\n"), 0o600)
+	passwords, err := LoadBreachedPasswords(path)
+	assert.Nil(t, err)
+	BreachedPasswords = passwords
+	defer func() { BreachedPasswords = map[string]struct{}{} }()
+	router := mux.NewRouter()
+	AddApiRoutes(router, &Servicers{db: db})
+	app := httptest.NewServer(router)
+	defer app.Close()
+
+	var respBody1, respBody2 GenericResponse
+	resp1 := Post(app.URL+"/api/user/", CreateUserRequest{
+		Email: "test@test.com", Password: "qwerty123",
+	}, &respBody1)
+	resp2 := Post(app.URL+"/api/user/", CreateUserRequest{
+		Email: "test@test.com", Password: "qwerty1234",
+	}, &respBody2)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, "This password is too common, it's been found in data breaches", respBody1.Error)
+	assert.Equal(t, http.StatusCreated, resp2.StatusCode)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// StartTestProxyAuthApp serves the API in this process, trusting the header
+// from the given proxies. Requests from the test itself come from 127.0.0.1.
+func StartTestProxyAuthApp(cidrs string) *httptest.Server {
+	config, err := LoadProxyAuth("X-Forwarded-Email", cidrs)
+	if err != nil {
+		panic(err)
+	}
+	ProxyAuth = config
+	router := mux.NewRouter()
+	AddApiRoutes(router, &Servicers{db: db})
+	return httptest.NewServer(router)
+}
+
+func GetWithProxyEmail(url string, email string, res any) *http.Response {
+	return DoWithProxyEmail("GET", url, email, nil, res)
+}
+
+func DoWithProxyEmail(method string, url string, email string, body any, res any) *http.Response {
+	reqBytes, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Forwarded-Email", email)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func TestProxyAuth_provisioned(t *testing.T) {
+	clearDb()
+	app := StartTestProxyAuthApp("10.0.0.0/8, 127.0.0.1/32")
+	defer app.Close()
+	defer func() { ProxyAuth = nil }()
+
+	var respBody1, respBody2 UserResponse
+	resp := GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &respBody1)
+	GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &respBody2)
+	var users int
+	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "test@corp.com", respBody1.Email)
+	assert.True(t, respBody1.Verified)
+	assert.Equal(t, respBody1.Id, respBody2.Id)
+	assert.Equal(t, 1, users)
+	assert.Empty(t, resp.Cookies())
+}
+
+func TestProxyAuth_existingUser(t *testing.T) {
+	clearDb()
+	userId, _ := LoginUser("test@corp.com")
+	app := StartTestProxyAuthApp("127.0.0.1/32")
+	defer app.Close()
+	defer func() { ProxyAuth = nil }()
+
+	var respBody UserResponse
+	GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &respBody)
+	assert.Equal(t, userId, respBody.Id)
+}
+
+func TestProxyAuth_unverifiedAccountTakenBack(t *testing.T) {
+	clearDb()
+	// Someone else signed up with the email first, but never verified it.
+	userId, squatter := LoginUser("test@corp.com")
+	app := StartTestProxyAuthApp("127.0.0.1/32")
+	defer app.Close()
+	defer func() { ProxyAuth = nil }()
+
+	var respBody UserResponse
+	GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &respBody)
+	resp := GetWithClient(squatter, USER_API, &GenericResponse{})
+	passwordUserId, err := Authenticate(db, "test@corp.com", "12345")
+	assert.Equal(t, userId, respBody.Id)
+	assert.True(t, respBody.Verified)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, passwordUserId)
+}
+
+func TestProxyAuth_deletionCancelled(t *testing.T) {
+	clearDb()
+	app := StartTestProxyAuthApp("127.0.0.1/32")
+	defer app.Close()
+	defer func() { ProxyAuth = nil }()
+
+	// They've no password, but the proxy vouches for them.
+	var deleteBody DeleteUserResponse
+	resp1 := DoWithProxyEmail(
+		"DELETE", app.URL+"/api/user/", "test@corp.com", DeleteUserRequest{}, &deleteBody,
+	)
+	var deleting1, deleting2 bool
+	db.QueryRow("SELECT delete_at IS NOT NULL FROM users").Scan(&deleting1)
+	resp2 := GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &UserResponse{})
+	db.QueryRow("SELECT delete_at IS NOT NULL FROM users").Scan(&deleting2)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.NotEmpty(t, deleteBody.DeleteAt)
+	assert.True(t, deleting1)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.False(t, deleting2)
+}
+
+func TestProxyAuth_untrustedProxy(t *testing.T) {
+	clearDb()
+	app := StartTestProxyAuthApp("10.0.0.0/8")
+	defer app.Close()
+	defer func() { ProxyAuth = nil }()
+
+	var respBody GenericResponse
+	resp := GetWithProxyEmail(app.URL+"/api/user/", "test@corp.com", &respBody)
+	var users int
+	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, 0, users)
+}
+
+func TestProxyAuth_requiresCidrs(t *testing.T) {
+	config, err1 := LoadProxyAuth("X-Forwarded-Email", "")
+	_, err2 := LoadProxyAuth("X-Forwarded-Email", "not-a-cidr")
+	disabled, err3 := LoadProxyAuth("", "")
+	assert.Nil(t, config)
+	assert.NotNil(t, err1)
+	assert.NotNil(t, err2)
+	assert.Nil(t, disabled)
+	assert.Nil(t, err3)
+}
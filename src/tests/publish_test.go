@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func PublishTestMutableDrawing(client *http.Client, drawingId int) string {
+	var respBody PublishMutableDrawingResponse
+	PostWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/publish", drawingId), nil, &respBody)
+	return respBody.PublishToken
+}
+
+func TestPublishMutableDrawing_latestVersion(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	token := PublishTestMutableDrawing(client, drawingId)
+	PatchWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId),
+		UpdateMutableDrawingRequest{Data: "{\"test\": \"updated\"}"},
+		&GenericResponse{},
+	)
+	var respBody GetPublishedMutableDrawingResponse
+	resp := Get(DRAWINGS_API+"published/"+token, &respBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "test1", respBody.Name)
+	assert.Equal(t, "{\"test\": \"updated\"}", respBody.Data)
+}
+
+func TestPublishMutableDrawing_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	resp := PostWithClient(client2, DRAWINGS_API+fmt.Sprintf("mutable/%d/publish", drawingId), nil, &GenericResponse{})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPublishMutableDrawing_regenerated(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	token1 := PublishTestMutableDrawing(client, drawingId)
+	token2 := PublishTestMutableDrawing(client, drawingId)
+	resp1 := Get(DRAWINGS_API+"published/"+token1, &GenericResponse{})
+	resp2 := Get(DRAWINGS_API+"published/"+token2, &GetPublishedMutableDrawingResponse{})
+	assert.NotEqual(t, token1, token2)
+	assert.Equal(t, http.StatusNotFound, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+}
+
+func TestUnpublishMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	token := PublishTestMutableDrawing(client, drawingId)
+	resp1 := DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d/publish", drawingId), &GenericResponse{})
+	resp2 := Get(DRAWINGS_API+"published/"+token, &GenericResponse{})
+	var respBody GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &respBody)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+	assert.Equal(t, "", respBody.PublishToken)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchMutableDrawings_drawnText(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(
+		client, "architecture", "{\"layers\": [{\"text\": \"ledger service\"}]}",
+	)
+	CreateTestMutableDrawing(
+		client, "other", "{\"layers\": [{\"text\": \"payments gateway\"}]}",
+	)
+	var respBody SearchMutableDrawingsResponse
+	resp := GetWithClient(client, DRAWINGS_API+"search?q=ledger", &respBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, respBody.Results, 1)
+	assert.Equal(t, drawingId, respBody.Results[0].Id)
+	assert.Equal(t, "<mark>ledger</mark> service", respBody.Results[0].TextHighlight)
+}
+
+func TestSearchMutableDrawings_cellsAndName(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	CreateTestMutableDrawing(
+		client, "cells", "{\"cells\": [\"l\", \"e\", \"d\", \"g\", \"e\", \"r\"]}",
+	)
+	CreateTestMutableDrawing(client, "ledger flow", "{\"test\": \"test\"}")
+	var respBody SearchMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"search?q=ledger", &respBody)
+	assert.Len(t, respBody.Results, 2)
+}
+
+func TestSearchMutableDrawings_updated(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(
+		client, "architecture", "{\"layers\": [{\"text\": \"payments gateway\"}]}",
+	)
+	PatchWithClient(
+		client,
+		DRAWINGS_API+"mutable/"+fmt.Sprint(drawingId),
+		UpdateMutableDrawingRequest{Data: "{\"layers\": [{\"text\": \"ledger service\"}]}"},
+		&GenericResponse{},
+	)
+	var respBody SearchMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"search?q=ledger", &respBody)
+	assert.Len(t, respBody.Results, 1)
+}
+
+func TestSearchMutableDrawings_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	CreateTestMutableDrawing(
+		client1, "architecture", "{\"layers\": [{\"text\": \"ledger service\"}]}",
+	)
+	var respBody SearchMutableDrawingsResponse
+	GetWithClient(client2, DRAWINGS_API+"search?q=ledger", &respBody)
+	assert.Empty(t, respBody.Results)
+}
+
+func TestSearchMutableDrawings_badRequest(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	resp := GetWithClient(client, DRAWINGS_API+"search?q=", &GenericResponse{})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func GetSessionKey(client *http.Client) string {
+	apiUrl, _ := url.Parse(USER_API)
+	for _, cookie := range client.Jar.Cookies(apiUrl) {
+		if cookie.Name == "sessionKey" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// GetWithSessionKey makes a request with just the given session key, so it's
+// not replaced as it's rotated.
+func GetWithSessionKey(url string, key string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "sessionKey", Value: key})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSessions_hashedAtRest(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	key := GetSessionKey(client)
+	var raw, hashed int
+	db.QueryRow("SELECT COUNT(*) FROM sessions WHERE key_hash = ?", key).Scan(&raw)
+	db.QueryRow("SELECT COUNT(*) FROM sessions WHERE key_hash = ?", HashSessionKey(key)).Scan(&hashed)
+	assert.NotEmpty(t, key)
+	assert.Equal(t, 0, raw)
+	assert.Equal(t, 1, hashed)
+}
+
+func TestSessions_refreshed(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	oldKey := GetSessionKey(client)
+	resp1 := GetWithSessionKey(USER_API, oldKey)
+	db.Exec("UPDATE sessions SET rotated_at = UTC_TIMESTAMP() - INTERVAL 2 DAY")
+	resp2 := GetWithSessionKey(USER_API, oldKey)
+	newCookie, err := GetCookie(resp2, "sessionKey")
+	assert.Nil(t, err)
+	// The old key still works for a little while, without rotating again.
+	resp3 := GetWithSessionKey(USER_API, oldKey)
+	db.Exec("UPDATE sessions SET rotated_at = UTC_TIMESTAMP() - INTERVAL 2 MINUTE")
+	resp4 := GetWithSessionKey(USER_API, oldKey)
+	resp5 := GetWithSessionKey(USER_API, newCookie.Value)
+
+	_, err = GetCookie(resp1, "sessionKey")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, oldKey, newCookie.Value)
+	assert.Equal(t, http.StatusOK, resp3.StatusCode)
+	assert.Empty(t, resp3.Cookies())
+	assert.Equal(t, http.StatusUnauthorized, resp4.StatusCode)
+	assert.Equal(t, http.StatusOK, resp5.StatusCode)
+}
+
+func TestSessions_rotatedOnPasswordChange(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	oldKey := GetSessionKey(client)
+	var respBody GenericResponse
+	resp1 := PostWithClient(client, USER_API+"password", ChangePasswordRequest{
+		CurrentPassword: "12345", NewPassword: "123456",
+	}, &respBody)
+	resp2 := GetWithSessionKey(USER_API, oldKey)
+	resp3 := GetWithClient(client, USER_API, &UserResponse{})
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions)
+
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.NotEqual(t, oldKey, GetSessionKey(client))
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.Equal(t, http.StatusOK, resp3.StatusCode)
+	assert.Equal(t, 1, sessions)
+}
+
+func TestRotateSession_unknownKey(t *testing.T) {
+	clearDb()
+	key, err := RotateSession(db, "unknown")
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+}
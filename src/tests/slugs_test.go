@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func CreateTestImmutableDrawing(data string) string {
+	var respBody CreateImmutableDrawingResponse
+	Post(DRAWINGS_API+"immutable", CreateImmutableDrawingRequest{Data: data}, &respBody)
+	return respBody.ShortKey
+}
+
+func TestClaimSlug_unauthorized(t *testing.T) {
+	clearDb()
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	resp := Post(
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestClaimSlug_invalid(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	var respBody1 GenericResponse
+	var respBody2 GenericResponse
+	PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "Payments Flow!", ShortKey: shortKey},
+		&respBody1,
+	)
+	PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "api", ShortKey: shortKey},
+		&respBody2,
+	)
+	assert.Equal(t, "Invalid slug", respBody1.Error)
+	assert.Equal(t, "Slug is reserved", respBody2.Error)
+}
+
+func TestClaimSlug_taken(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	PostWithClient(
+		client1,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	var respBody GenericResponse
+	resp := PostWithClient(
+		client2,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&respBody,
+	)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Slug already taken", respBody.Error)
+}
+
+func TestClaimSlug_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	resp1 := PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	var respBody GetImmutableDrawingResponse
+	resp2 := Get(DRAWINGS_API+"immutable/payments-flow", &respBody)
+	assert.Equal(t, http.StatusCreated, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, "{\"test\": \"test\"}", respBody.Data)
+}
+
+func TestClaimSlug_notTakenOverByShortKey(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	shortKey := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	// Find a drawing whose first choice of short key would do as a slug.
+	var data, slug string
+	for i := 0; !IsValidSlug(slug); i++ {
+		data = fmt.Sprintf("{\"test\": %d}", i)
+		slug = ShortKeyGenerator.Key(Hash(data), 0)
+	}
+	resp := PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: slug, ShortKey: shortKey},
+		&GenericResponse{},
+	)
+	otherShortKey := CreateTestImmutableDrawing(data)
+	var respBody GetImmutableDrawingResponse
+	Get(DRAWINGS_API+"immutable/"+slug, &respBody)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEqual(t, slug, otherShortKey)
+	assert.Equal(t, "{\"test\": \"test\"}", respBody.Data)
+}
+
+func TestUpdateSlug_history(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	shortKey1 := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	shortKey2 := CreateTestImmutableDrawing("{\"test\": \"updated\"}")
+	PostWithClient(
+		client,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey1},
+		&GenericResponse{},
+	)
+	resp1 := PatchWithClient(
+		client,
+		DRAWINGS_API+"slug/payments-flow",
+		UpdateSlugRequest{ShortKey: shortKey2},
+		&GenericResponse{},
+	)
+	var respBody1 GetImmutableDrawingResponse
+	Get(DRAWINGS_API+"immutable/payments-flow", &respBody1)
+	var respBody2 SlugResponse
+	resp2 := GetWithClient(client, DRAWINGS_API+"slug/payments-flow", &respBody2)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, "{\"test\": \"updated\"}", respBody1.Data)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, shortKey2, respBody2.ShortKey)
+	assert.Len(t, respBody2.History, 1)
+	assert.Equal(t, shortKey1, respBody2.History[0].ShortKey)
+}
+
+func TestUpdateSlug_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	shortKey1 := CreateTestImmutableDrawing("{\"test\": \"test\"}")
+	shortKey2 := CreateTestImmutableDrawing("{\"test\": \"updated\"}")
+	PostWithClient(
+		client1,
+		DRAWINGS_API+"slug",
+		ClaimSlugRequest{Slug: "payments-flow", ShortKey: shortKey1},
+		&GenericResponse{},
+	)
+	resp := PatchWithClient(
+		client2,
+		DRAWINGS_API+"slug/payments-flow",
+		UpdateSlugRequest{ShortKey: shortKey2},
+		&GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TagTestMutableDrawing(client *http.Client, drawingId int, tags ...string) *http.Response {
+	return PostWithClient(
+		client,
+		DRAWINGS_API+fmt.Sprintf("mutable/%d/tags", drawingId),
+		TagMutableDrawingRequest{Tags: tags},
+		&GenericResponse{},
+	)
+}
+
+func TestTagMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	resp := TagTestMutableDrawing(client, drawingId, "payments", " K8s ", "payments")
+	var respBody GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &respBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"k8s", "payments"}, respBody.Tags)
+}
+
+func TestTagMutableDrawing_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	resp := TagTestMutableDrawing(client2, drawingId, "payments")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestCreateMutableDrawing_withTags(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1 CreateMutableDrawingResponse
+	PostWithClient(
+		client,
+		DRAWINGS_API+"mutable",
+		CreateMutableDrawingRequest{Name: "test", Data: "{\"test\": \"test\"}", Tags: []string{"draft"}},
+		&respBody1,
+	)
+	var respBody2 GetMutableDrawingResponse
+	GetWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", respBody1.Id), &respBody2)
+	assert.Equal(t, []string{"draft"}, respBody2.Tags)
+}
+
+func TestUntagMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	TagTestMutableDrawing(client, drawingId, "payments", "draft")
+	resp1 := DeleteWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d/tags/draft", drawingId), &GenericResponse{},
+	)
+	resp2 := DeleteWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d/tags/draft", drawingId), &GenericResponse{},
+	)
+	var respBody ListTagsResponse
+	GetWithClient(client, DRAWINGS_API+"tags", &respBody)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+	assert.Equal(t, []TagResponse{{Name: "payments", Count: 1}}, respBody.Results)
+}
+
+func TestListTags_counts(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId1 := CreateTestMutableDrawing(client1, "test1")
+	drawingId2 := CreateTestMutableDrawing(client1, "test2")
+	drawingId3 := CreateTestMutableDrawing(client2, "test3")
+	TagTestMutableDrawing(client1, drawingId1, "payments", "draft")
+	TagTestMutableDrawing(client1, drawingId2, "payments")
+	TagTestMutableDrawing(client2, drawingId3, "payments")
+	var respBody ListTagsResponse
+	GetWithClient(client1, DRAWINGS_API+"tags", &respBody)
+	assert.Equal(
+		t,
+		[]TagResponse{{Name: "draft", Count: 1}, {Name: "payments", Count: 2}},
+		respBody.Results,
+	)
+}
+
+func TestListMutableDrawings_byTags(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId1 := CreateTestMutableDrawing(client, "test1")
+	drawingId2 := CreateTestMutableDrawing(client, "test2")
+	CreateTestMutableDrawing(client, "test3")
+	TagTestMutableDrawing(client, drawingId1, "payments", "k8s")
+	TagTestMutableDrawing(client, drawingId2, "payments")
+	var respBody1 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables?tags=payments,k8s", &respBody1)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables?tags=payments,k8s&tag_match=all", &respBody2)
+	assert.Len(t, respBody1.Results, 2)
+	assert.Equal(t, 2, respBody1.Total)
+	assert.Len(t, respBody2.Results, 1)
+	assert.Equal(t, "test1", respBody2.Results[0].Name)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func EnableTestTotp(client *http.Client) (string, []string) {
+	var beginBody BeginTotpResponse
+	PostWithClient(client, USER_API+"totp", nil, &beginBody)
+	var confirmBody ConfirmTotpResponse
+	PostWithClient(
+		client,
+		USER_API+"totp/confirm",
+		ConfirmTotpRequest{Code: TotpCode(beginBody.Secret, TotpStep(time.Now()))},
+		&confirmBody,
+	)
+	return beginBody.Secret, confirmBody.RecoveryCodes
+}
+
+func StartTestMfaLogin(client *http.Client, email string) string {
+	var respBody AuthUserResponse
+	PostWithClient(
+		client,
+		USER_API+"auth",
+		AuthUserRequest{Email: email, Password: "12345"},
+		&respBody,
+	)
+	return respBody.MfaToken
+}
+
+func TestTotpCode_rfcVectors(t *testing.T) {
+	// From RFC 6238, truncated to 6 digits.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	assert.Equal(t, "287082", TotpCode(secret, TotpStep(time.Unix(59, 0))))
+	assert.Equal(t, "081804", TotpCode(secret, TotpStep(time.Unix(1111111109, 0))))
+	assert.Equal(t, "005924", TotpCode(secret, TotpStep(time.Unix(1234567890, 0))))
+}
+
+func TestTotp_enrolAndLogin(t *testing.T) {
+	clearDb()
+	userId, client1 := LoginUser("test@test.com")
+	var beginBody BeginTotpResponse
+	resp1 := PostWithClient(client1, USER_API+"totp", nil, &beginBody)
+	var confirmBody ConfirmTotpResponse
+	resp2 := PostWithClient(
+		client1,
+		USER_API+"totp/confirm",
+		ConfirmTotpRequest{Code: TotpCode(beginBody.Secret, TotpStep(time.Now()))},
+		&confirmBody,
+	)
+
+	client2 := MakeCookieClient()
+	mfaToken := StartTestMfaLogin(client2, "test@test.com")
+	var userBody1 GenericResponse
+	resp3 := GetWithClient(client2, USER_API, &userBody1)
+	resp4 := PostWithClient(
+		client2,
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: mfaToken, Code: TotpCode(beginBody.Secret, TotpStep(time.Now()))},
+		&GenericResponse{},
+	)
+	var userBody2 UserResponse
+	GetWithClient(client2, USER_API, &userBody2)
+
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Contains(t, beginBody.OtpauthUri, "otpauth://totp/cascii:test@test.com?")
+	assert.Contains(t, beginBody.OtpauthUri, "secret="+beginBody.Secret)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Len(t, confirmBody.RecoveryCodes, 10)
+	assert.NotEmpty(t, mfaToken)
+	assert.Equal(t, http.StatusUnauthorized, resp3.StatusCode)
+	assert.Equal(t, http.StatusAccepted, resp4.StatusCode)
+	assert.Equal(t, userId, userBody2.Id)
+	assert.True(t, userBody2.TotpEnabled)
+}
+
+func TestTotp_wrongConfirmCode(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	PostWithClient(client, USER_API+"totp", nil, &BeginTotpResponse{})
+	var respBody GenericResponse
+	resp := PostWithClient(client, USER_API+"totp/confirm", ConfirmTotpRequest{Code: "000000"}, &respBody)
+	var userBody UserResponse
+	GetWithClient(client, USER_API, &userBody)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid code", respBody.Error)
+	assert.False(t, userBody.TotpEnabled)
+}
+
+func TestTotp_codeReplayed(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	secret, _ := EnableTestTotp(client)
+	code := TotpCode(secret, TotpStep(time.Now()))
+	resp1 := Post(
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: StartTestMfaLogin(MakeCookieClient(), "test@test.com"), Code: code},
+		&GenericResponse{},
+	)
+	var respBody GenericResponse
+	resp2 := Post(
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: StartTestMfaLogin(MakeCookieClient(), "test@test.com"), Code: code},
+		&respBody,
+	)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.Equal(t, "Invalid code", respBody.Error)
+}
+
+func TestTotp_recoveryCode(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	_, recoveryCodes := EnableTestTotp(client)
+	resp1 := Post(
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: StartTestMfaLogin(MakeCookieClient(), "test@test.com"), Code: recoveryCodes[0]},
+		&GenericResponse{},
+	)
+	resp2 := Post(
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: StartTestMfaLogin(MakeCookieClient(), "test@test.com"), Code: recoveryCodes[0]},
+		&GenericResponse{},
+	)
+	var codeHash string
+	db.QueryRow("SELECT code_hash FROM recovery_codes LIMIT 1").Scan(&codeHash)
+	assert.Equal(t, http.StatusAccepted, resp1.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp2.StatusCode)
+	assert.NotContains(t, recoveryCodes, codeHash)
+}
+
+func TestTotp_lockedOut(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	secret, _ := EnableTestTotp(client)
+	mfaToken := StartTestMfaLogin(MakeCookieClient(), "test@test.com")
+	for range MaxTotpFailures {
+		Post(USER_API+"auth/mfa", MfaAuthRequest{MfaToken: mfaToken, Code: "000000"}, &GenericResponse{})
+	}
+	var respBody GenericResponse
+	resp := Post(
+		USER_API+"auth/mfa",
+		MfaAuthRequest{MfaToken: mfaToken, Code: TotpCode(secret, TotpStep(time.Now()))},
+		&respBody,
+	)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "Too many attempts, try again later", respBody.Error)
+}
+
+func TestTotp_badMfaToken(t *testing.T) {
+	clearDb()
+	var respBody GenericResponse
+	resp := Post(USER_API+"auth/mfa", MfaAuthRequest{MfaToken: "bad", Code: "000000"}, &respBody)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Login expired, please try again", respBody.Error)
+}
+
+func TestTotp_disable(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	_, recoveryCodes := EnableTestTotp(client)
+	resp1 := DeleteWithClientAndBody(
+		client, USER_API+"totp", DisableTotpRequest{Password: "wrong", Code: recoveryCodes[0]}, &GenericResponse{},
+	)
+	resp2 := DeleteWithClientAndBody(
+		client, USER_API+"totp", DisableTotpRequest{Password: "12345", Code: recoveryCodes[0]}, &GenericResponse{},
+	)
+	var authBody AuthUserResponse
+	resp3 := PostWithClient(
+		MakeCookieClient(),
+		USER_API+"auth",
+		AuthUserRequest{Email: "test@test.com", Password: "12345"},
+		&authBody,
+	)
+	var recoveryCodesLeft int
+	db.QueryRow("SELECT COUNT(*) FROM recovery_codes").Scan(&recoveryCodesLeft)
+	assert.Equal(t, http.StatusUnauthorized, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Equal(t, http.StatusAccepted, resp3.StatusCode)
+	assert.Empty(t, authBody.MfaToken)
+	assert.Equal(t, 0, recoveryCodesLeft)
+}
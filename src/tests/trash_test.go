@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListTrash_deletedDrawing(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	CreateTestMutableDrawing(client, "test2")
+	DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GenericResponse{})
+	var respBody1 ListTrashResponse
+	resp := GetWithClient(client, DRAWINGS_API+"trash", &respBody1)
+	var respBody2 ListMutableDrawingsResponse
+	GetWithClient(client, DRAWINGS_API+"mutables", &respBody2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, respBody1.Results, 1)
+	assert.Equal(t, drawingId, respBody1.Results[0].Id)
+	assert.NotEmpty(t, respBody1.Results[0].DeletedAt)
+	assert.NotEmpty(t, respBody1.Results[0].PurgeAt)
+	assert.Len(t, respBody2.Results, 1)
+	assert.Equal(t, "test2", respBody2.Results[0].Name)
+}
+
+func TestRestoreMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GenericResponse{})
+	resp1 := PostWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("trash/%d/restore", drawingId), nil, &GenericResponse{},
+	)
+	resp2 := GetWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GetMutableDrawingResponse{},
+	)
+	var respBody ListTrashResponse
+	GetWithClient(client, DRAWINGS_API+"trash", &respBody)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	assert.Empty(t, respBody.Results)
+}
+
+func TestRestoreMutableDrawing_differentUserNoAccess(t *testing.T) {
+	clearDb()
+	_, client1 := LoginUser("test@test.com")
+	_, client2 := LoginUser("test1@test.com")
+	drawingId := CreateTestMutableDrawing(client1, "test1")
+	DeleteWithClient(client1, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GenericResponse{})
+	resp := PostWithClient(
+		client2, DRAWINGS_API+fmt.Sprintf("trash/%d/restore", drawingId), nil, &GenericResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPurgeMutableDrawing_notInTrash(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	resp1 := DeleteWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("trash/%d", drawingId), &GenericResponse{},
+	)
+	resp2 := GetWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GetMutableDrawingResponse{},
+	)
+	assert.Equal(t, http.StatusNotFound, resp1.StatusCode)
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+}
+
+func TestPurgeMutableDrawing_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	drawingId := CreateTestMutableDrawing(client, "test1")
+	DeleteWithClient(client, DRAWINGS_API+fmt.Sprintf("mutable/%d", drawingId), &GenericResponse{})
+	resp1 := DeleteWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("trash/%d", drawingId), &GenericResponse{},
+	)
+	resp2 := PostWithClient(
+		client, DRAWINGS_API+fmt.Sprintf("trash/%d/restore", drawingId), nil, &GenericResponse{},
+	)
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+}
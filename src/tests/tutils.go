@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 var db, err = sql.Open("mysql", fmt.Sprintf(
@@ -21,7 +23,27 @@ var db, err = sql.Open("mysql", fmt.Sprintf(
 ))
 
 func clearDb() {
-	tables := []string{"sessions", "users", "mutable_drawings", "immutable_drawings"}
+	// Ordered so that rows are deleted before those they reference.
+	tables := []string{
+		"sessions",
+		"login_links",
+		"recovery_codes",
+		"slug_history",
+		"slugs",
+		"mutable_drawing_tags",
+		"tags",
+		"mutable_drawing_history",
+		"edit_links",
+		"mutable_drawings",
+		"folders",
+		"data_exports",
+		"invites",
+		"users",
+		"immutable_drawings",
+	}
+	// Folders reference each other too, and users the invites of other users.
+	db.Exec("UPDATE folders SET parent_id = NULL")
+	db.Exec("UPDATE users SET invite_id = NULL")
 	for _, table := range tables {
 		db.Exec("DELETE FROM " + table)
 		db.Exec(fmt.Sprintf("ALTER TABLE %s AUTO_INCREMENT=1", table))
@@ -70,10 +92,10 @@ func PatchWithClient(client *http.Client, url string, req any, res any) *http.Re
 	}
 	request.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(request)
-	defer resp.Body.Close()
 	if err != nil {
 		panic(err)
 	}
+	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(res)
 	if err != nil {
 		panic(err)
@@ -85,10 +107,10 @@ func PostWithClient(client *http.Client, url string, req any, res any) *http.Res
 	var buf bytes.Buffer
 	json.NewEncoder(&buf).Encode(req)                       // Writes to buf
 	resp, err := client.Post(url, "application/json", &buf) // Reads from buf
-	defer resp.Body.Close()
 	if err != nil {
 		panic(err)
 	}
+	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(res)
 	if err != nil {
 		panic(err)
@@ -98,10 +120,10 @@ func PostWithClient(client *http.Client, url string, req any, res any) *http.Res
 
 func GetWithClient(client *http.Client, url string, res any) *http.Response {
 	resp, err := client.Get(url)
-	defer resp.Body.Close()
 	if err != nil {
 		panic(err)
 	}
+	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(res)
 	if err != nil {
 		panic(err)
@@ -115,10 +137,29 @@ func DeleteWithClient(client *http.Client, url string, res any) *http.Response {
 		panic(err)
 	}
 	resp, err := client.Do(request)
+	if err != nil {
+		panic(err)
+	}
 	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func DeleteWithClientAndBody(client *http.Client, url string, req any, res any) *http.Response {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(req)
+	request, err := http.NewRequest(http.MethodDelete, url, &buf)
 	if err != nil {
 		panic(err)
 	}
+	resp, err := client.Do(request)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(res)
 	if err != nil {
 		panic(err)
@@ -126,6 +167,45 @@ func DeleteWithClient(client *http.Client, url string, res any) *http.Response {
 	return resp
 }
 
+// ReadLatestMailLink finds the link in the latest mail sent to the address,
+// which the server writes to MAIL_DIR when testing.
+func ReadLatestMailLink(to string) string {
+	files, err := os.ReadDir(filepath.Join(os.Getenv("MAIL_DIR"), to))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+	// Named by time sent, so the last is the latest.
+	content, err := os.ReadFile(filepath.Join(os.Getenv("MAIL_DIR"), to, files[len(files)-1].Name()))
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "http") {
+			return line
+		}
+	}
+	return ""
+}
+
+// CountMails counts the mails ever sent to the address, as ReadLatestMailLink
+// finds them. They're kept between tests, so only the change means anything.
+func CountMails(to string) int {
+	files, _ := os.ReadDir(filepath.Join(os.Getenv("MAIL_DIR"), to))
+	return len(files)
+}
+
+// CreateTestMutableDrawing creates a drawing as the client's user, with the
+// given data or else some placeholder, and returns its id.
+func CreateTestMutableDrawing(client *http.Client, name string, data ...string) int {
+	request := CreateMutableDrawingRequest{Name: name, Data: "{\"test\": \"test\"}"}
+	if len(data) > 0 {
+		request.Data = data[0]
+	}
+	var respBody CreateMutableDrawingResponse
+	PostWithClient(client, DRAWINGS_API+"mutable", request, &respBody)
+	return respBody.Id
+}
+
 func LoginUser(email string) (int, *http.Client) {
 	client := MakeCookieClient()
 	PostWithClient(
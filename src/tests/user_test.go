@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -172,3 +173,56 @@ func TestGetUser_unauthorized(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.Equal(t, "Unauthorized", respBody.Error)
 }
+
+func TestVerifyEmail_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	var respBody1, respBody2 UserResponse
+	GetWithClient(client, USER_API, &respBody1)
+	resp := Get(ReadLatestMailLink("test@test.com"), &GenericResponse{})
+	GetWithClient(client, USER_API, &respBody2)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, respBody1.Verified)
+	assert.True(t, respBody2.Verified)
+}
+
+func TestVerifyEmail_badToken(t *testing.T) {
+	clearDb()
+	var respBody GenericResponse
+	resp := Get(USER_API+"verify?token=bad", &respBody)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid or expired link", respBody.Error)
+}
+
+func TestResendVerification_successful(t *testing.T) {
+	clearDb()
+	_, client := LoginUser("test@test.com")
+	link1 := ReadLatestMailLink("test@test.com")
+	// Signed tokens only differ by the second they expire.
+	time.Sleep(time.Second)
+	db.Exec("UPDATE users SET verification_sent_at = UTC_TIMESTAMP() - INTERVAL 1 HOUR")
+	resp := Post(USER_API+"verify/resend", ResendVerificationRequest{Email: "test@test.com"}, &GenericResponse{})
+	link2 := ReadLatestMailLink("test@test.com")
+	Get(link2, &GenericResponse{})
+	var respBody UserResponse
+	GetWithClient(client, USER_API, &respBody)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.NotEqual(t, link1, link2)
+	assert.True(t, respBody.Verified)
+}
+
+func TestResendVerification_throttled(t *testing.T) {
+	clearDb()
+	LoginUser("test@test.com")
+	mails := CountMails("test@test.com")
+	resp := Post(USER_API+"verify/resend", ResendVerificationRequest{Email: "test@test.com"}, &GenericResponse{})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, mails, CountMails("test@test.com"))
+}
+
+func TestResendVerification_unknownEmail(t *testing.T) {
+	clearDb()
+	resp := Post(USER_API+"verify/resend", ResendVerificationRequest{Email: "nobody@test.com"}, &GenericResponse{})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Empty(t, ReadLatestMailLink("nobody@test.com"))
+}